@@ -0,0 +1,123 @@
+//! Times discovery over a generated tree of table-driven tests, with and
+//! without the subtest scan. Run with `cargo bench`; set
+//! GOTESTFINDER_BENCH_PACKAGES to change the size of the tree.
+
+use std::fmt::Write as _;
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+use std::time::{Duration, Instant};
+
+const FILES_PER_PACKAGE: usize = 5;
+const TESTS_PER_FILE: usize = 20;
+const CASES_PER_TEST: usize = 10;
+const ITERATIONS: usize = 5;
+
+fn main() {
+    let packages = std::env::var("GOTESTFINDER_BENCH_PACKAGES")
+        .ok()
+        .and_then(|value| value.parse().ok())
+        .unwrap_or(50);
+
+    let dir = std::env::temp_dir().join(format!("gotestfinder-bench-{}", std::process::id()));
+    let tree = dir.join("tree");
+    generate(&tree, packages);
+    println!(
+        "{} packages, {} tests, {} subtests",
+        packages,
+        packages * FILES_PER_PACKAGE * TESTS_PER_FILE,
+        packages * FILES_PER_PACKAGE * TESTS_PER_FILE * (CASES_PER_TEST + 1)
+    );
+
+    for (label, flags) in [
+        ("with subtests", &[][..]),
+        ("--no-subtests-scan", &["--no-subtests-scan"][..]),
+    ] {
+        let mut times: Vec<Duration> = (0..ITERATIONS)
+            .map(|_| discover(&tree, &dir.join("cache"), flags))
+            .collect();
+        times.sort();
+        println!(
+            "{:<20} median {:>9.2?}  min {:>9.2?}",
+            label,
+            times[ITERATIONS / 2],
+            times[0]
+        );
+    }
+
+    let _ = std::fs::remove_dir_all(dir);
+}
+
+/// Lists every test under `tree` once with an empty parse cache, so that
+/// every file is read and parsed.
+fn discover(tree: &Path, cache: &Path, flags: &[&str]) -> Duration {
+    let _ = std::fs::remove_dir_all(cache);
+
+    let started = Instant::now();
+    let status = Command::new(env!("CARGO_BIN_EXE_gotestfinder"))
+        .args(flags)
+        .arg(tree)
+        .env("XDG_CACHE_HOME", cache)
+        .stdout(Stdio::null())
+        .status()
+        .expect("gotestfinder runs");
+    let elapsed = started.elapsed();
+
+    assert!(status.success(), "gotestfinder failed: {}", status);
+    elapsed
+}
+
+/// Writes `packages` packages of table-driven tests, each with a literal
+/// subtest and a map of cases run through a helper.
+fn generate(tree: &Path, packages: usize) {
+    for package in 0..packages {
+        let dir: PathBuf = tree.join(format!("pkg{}", package));
+        std::fs::create_dir_all(&dir).unwrap();
+
+        for file in 0..FILES_PER_PACKAGE {
+            let mut source = format!(
+                "package pkg{}\n\nimport \"testing\"\n\n\
+                 func check{}(t *testing.T, name string, in int) {{\n\
+                 \tt.Helper()\n\
+                 \tt.Run(name, func(t *testing.T) {{ _ = in }})\n\
+                 }}\n",
+                package, file
+            );
+
+            for test in 0..TESTS_PER_FILE {
+                write!(
+                    source,
+                    "\nfunc TestCase{}_{}(t *testing.T) {{\n\
+                     \tcases := map[string]struct {{\n\
+                     \t\tin   int\n\
+                     \t\twant int\n\
+                     \t}}{{\n",
+                    file, test
+                )
+                .unwrap();
+                for case in 0..CASES_PER_TEST {
+                    writeln!(
+                        source,
+                        "\t\t\"case {}\": {{in: {}, want: {}}},",
+                        case,
+                        case,
+                        case * 2
+                    )
+                    .unwrap();
+                }
+                write!(
+                    source,
+                    "\t}}\n\
+                     \tfor name, tc := range cases {{\n\
+                     \t\tt.Run(name, func(t *testing.T) {{ _ = tc }})\n\
+                     \t}}\n\
+                     \tcheck{}(t, \"helper\", 1)\n\
+                     }}\n",
+                    file
+                )
+                .unwrap();
+            }
+
+            std::fs::write(dir.join(format!("file{}_test.go", file)), source).unwrap();
+        }
+    }
+}
@@ -0,0 +1,39 @@
+use std::process::Command;
+
+/// Records the commit and compiler the binary is built from for --version.
+/// Builds outside a git checkout, e.g. from crates.io, report "unknown".
+fn main() {
+    let commit = output("git", &["rev-parse", "--short=12", "HEAD"]).map(|commit| {
+        let dirty = output("git", &["status", "--porcelain", "--untracked-files=no"])
+            .is_some_and(|status| !status.is_empty());
+        if dirty {
+            format!("{}-dirty", commit)
+        } else {
+            commit
+        }
+    });
+
+    let rustc = std::env::var("RUSTC").unwrap_or_else(|_| "rustc".to_string());
+
+    println!(
+        "cargo:rustc-env=GOTESTFINDER_COMMIT={}",
+        commit.as_deref().unwrap_or("unknown")
+    );
+    println!(
+        "cargo:rustc-env=GOTESTFINDER_RUSTC={}",
+        output(&rustc, &["--version"])
+            .as_deref()
+            .unwrap_or("unknown")
+    );
+    println!("cargo:rerun-if-changed=.git/HEAD");
+    println!("cargo:rerun-if-changed=.git/index");
+}
+
+fn output(program: &str, args: &[&str]) -> Option<String> {
+    let output = Command::new(program).args(args).output().ok()?;
+    if !output.status.success() {
+        return None;
+    }
+
+    Some(String::from_utf8_lossy(&output.stdout).trim().to_string())
+}
@@ -0,0 +1,218 @@
+use anyhow::{Result, bail};
+use std::collections::{HashMap, HashSet};
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+/// Returns the directories of packages affected by changes since `base`:
+/// packages whose Go files changed plus every package (including test
+/// packages) that transitively imports one of them. Falls back to just the
+/// changed packages when `go list` cannot be run.
+pub fn affected_dirs(dir: &str, base: &str, tags: Option<&str>) -> Result<HashSet<PathBuf>> {
+    let changed = changed_dirs(dir, base)?;
+
+    match reverse_deps(dir, &changed, tags) {
+        Ok(affected) => Ok(affected),
+        Err(err) => {
+            eprintln!(
+                "warning: go list failed ({}), only using packages changed since {}",
+                err, base
+            );
+            Ok(changed)
+        }
+    }
+}
+
+fn changed_dirs(dir: &str, base: &str) -> Result<HashSet<PathBuf>> {
+    let toplevel = git(dir, &["rev-parse", "--show-toplevel"])?;
+    let toplevel = Path::new(toplevel.trim());
+
+    let diff = git(dir, &["diff", "--name-only", base])?;
+    let untracked = git(
+        dir,
+        &["ls-files", "--others", "--exclude-standard", "--full-name"],
+    )?;
+
+    Ok(diff
+        .lines()
+        .chain(untracked.lines())
+        .filter(|file| file.ends_with(".go"))
+        .filter_map(|file| toplevel.join(file).parent().map(canonical))
+        .collect())
+}
+
+/// Returns the line ranges (1-based, inclusive) of Go files that changed since
+/// `base`, keyed by canonical path. Untracked files count as changed entirely.
+pub fn changed_lines(dir: &str, base: &str) -> Result<HashMap<PathBuf, Vec<(usize, usize)>>> {
+    let toplevel = git(dir, &["rev-parse", "--show-toplevel"])?;
+    let toplevel = Path::new(toplevel.trim());
+
+    let diff = git(
+        dir,
+        &[
+            "diff",
+            "--no-color",
+            "--no-ext-diff",
+            "-U0",
+            base,
+            "--",
+            "*.go",
+        ],
+    )?;
+    let untracked = git(
+        dir,
+        &["ls-files", "--others", "--exclude-standard", "--full-name"],
+    )?;
+
+    let mut changed: HashMap<PathBuf, Vec<(usize, usize)>> = HashMap::new();
+    let mut file = None;
+
+    for line in diff.lines() {
+        if let Some(path) = line.strip_prefix("+++ ") {
+            file = path
+                .strip_prefix("b/")
+                .map(|path| canonical(&toplevel.join(path)));
+        } else if line.starts_with("@@")
+            && let Some(file) = &file
+            && let Some(range) = hunk_range(line)
+        {
+            changed.entry(file.clone()).or_default().push(range);
+        }
+    }
+
+    for file in untracked.lines().filter(|file| file.ends_with(".go")) {
+        changed
+            .entry(canonical(&toplevel.join(file)))
+            .or_default()
+            .push((1, usize::MAX));
+    }
+
+    Ok(changed)
+}
+
+/// Returns the Go files with uncommitted changes according to `git status`:
+/// modified, staged, added or untracked, keyed by canonical path. Renamed
+/// files count under their new name.
+pub fn dirty_files(dir: &str) -> Result<HashSet<PathBuf>> {
+    let toplevel = git(dir, &["rev-parse", "--show-toplevel"])?;
+    let toplevel = Path::new(toplevel.trim());
+
+    let status = git(
+        dir,
+        &["status", "--porcelain", "-z", "--untracked-files=all"],
+    )?;
+
+    let mut dirty = HashSet::new();
+    let mut entries = status.split('\0');
+    while let Some(entry) = entries.next() {
+        let (Some(state), Some(file)) = (entry.get(..2), entry.get(3..)) else {
+            continue;
+        };
+        // Renames and copies are followed by the original path.
+        if state.contains(['R', 'C']) {
+            entries.next();
+        }
+        if file.ends_with(".go") {
+            dirty.insert(canonical(&toplevel.join(file)));
+        }
+    }
+
+    Ok(dirty)
+}
+
+/// Parses the new-file side of a `@@ -a,b +c,d @@` hunk header. A pure
+/// deletion is reported as the line it follows, which is still inside the
+/// code that lost it.
+fn hunk_range(header: &str) -> Option<(usize, usize)> {
+    let new = header.split_whitespace().nth(2)?.strip_prefix('+')?;
+    let (start, count) = match new.split_once(',') {
+        Some((start, count)) => (start.parse::<usize>().ok()?, count.parse::<usize>().ok()?),
+        None => (new.parse::<usize>().ok()?, 1),
+    };
+
+    Some((
+        start.max(1),
+        (start + count).saturating_sub(1).max(start.max(1)),
+    ))
+}
+
+fn reverse_deps(
+    dir: &str,
+    changed: &HashSet<PathBuf>,
+    tags: Option<&str>,
+) -> Result<HashSet<PathBuf>> {
+    let mut cmd = Command::new("go");
+    cmd.args(["list", "-e", "-deps", "-test"]);
+
+    if let Some(tags_value) = tags {
+        cmd.arg(format!("-tags={}", tags_value));
+    }
+
+    cmd.args([
+        "-f",
+        "{{.ImportPath}}\t{{.Dir}}\t{{join .Deps \" \"}}",
+        "./...",
+    ]);
+    cmd.current_dir(dir);
+
+    let output = cmd.output()?;
+    if !output.status.success() {
+        bail!("{}", String::from_utf8_lossy(&output.stderr).trim());
+    }
+
+    let stdout = String::from_utf8_lossy(&output.stdout);
+    let packages: Vec<(&str, PathBuf, Vec<&str>)> = stdout
+        .lines()
+        .filter_map(|line| {
+            let mut fields = line.split('\t');
+            let import_path = strip_variant(fields.next()?);
+            let pkg_dir = fields.next().filter(|d| !d.is_empty())?;
+            let deps = fields.next().unwrap_or("").split_whitespace();
+            Some((
+                import_path,
+                canonical(Path::new(pkg_dir)),
+                deps.map(strip_variant).collect(),
+            ))
+        })
+        .collect();
+
+    let changed_imports: HashSet<&str> = packages
+        .iter()
+        .filter(|(_, pkg_dir, _)| changed.contains(pkg_dir))
+        .map(|(import_path, _, _)| *import_path)
+        .collect();
+
+    let mut affected = changed.clone();
+    for (_, pkg_dir, deps) in &packages {
+        if deps.iter().any(|dep| changed_imports.contains(dep)) {
+            affected.insert(pkg_dir.clone());
+        }
+    }
+
+    Ok(affected)
+}
+
+/// Strips the test variant suffix `go list -test` adds, so that
+/// `example.com/a [example.com/a.test]` matches `example.com/a`.
+fn strip_variant(import_path: &str) -> &str {
+    import_path
+        .split_once(" [")
+        .map_or(import_path, |(path, _)| path)
+}
+
+fn git(dir: &str, args: &[&str]) -> Result<String> {
+    let output = Command::new("git").arg("-C").arg(dir).args(args).output()?;
+
+    if !output.status.success() {
+        bail!(
+            "git {} failed: {}",
+            args.join(" "),
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+
+    Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+}
+
+pub fn canonical(path: &Path) -> PathBuf {
+    std::fs::canonicalize(path).unwrap_or_else(|_| path.to_path_buf())
+}
@@ -0,0 +1,75 @@
+use anyhow::{Context, Result};
+use std::io::{self, BufRead, BufReader};
+use std::path::PathBuf;
+use std::process::{Command, ExitStatus, Stdio};
+
+use crate::state::state_dir;
+
+/// Runs a benchmark command with its plain output, which is what benchstat
+/// reads, then compares it with the `benchstat` baseline and saves it as the
+/// `save_as` baseline if asked.
+pub fn run(mut cmd: Command, benchstat: Option<&str>, save_as: Option<&str>) -> Result<ExitStatus> {
+    cmd.stdout(Stdio::piped());
+
+    let mut child = cmd.spawn()?;
+    let stdout = child.stdout.take().expect("stdout is piped");
+
+    let mut output = String::new();
+    for line in BufReader::new(stdout).lines() {
+        let line = line?;
+        println!("{}", line);
+        output.push_str(&line);
+        output.push('\n');
+    }
+
+    let status = child.wait()?;
+
+    if let Some(name) = benchstat {
+        compare(name, &output)?;
+    }
+
+    if let Some(name) = save_as {
+        let path = baseline_path(name).context("no cache directory to save baselines in")?;
+        std::fs::create_dir_all(path.parent().expect("baselines live in a directory"))?;
+        std::fs::write(&path, &output)?;
+        println!("Saved baseline {} to {}", name, path.display());
+    }
+
+    Ok(status)
+}
+
+fn compare(name: &str, output: &str) -> Result<()> {
+    let Some(baseline) = baseline_path(name).filter(|path| path.exists()) else {
+        eprintln!(
+            "note: no baseline {:?} yet, save one with --save-baseline {}",
+            name, name
+        );
+        return Ok(());
+    };
+
+    let current =
+        std::env::temp_dir().join(format!("gotestfinder-bench-{}.txt", std::process::id()));
+    std::fs::write(&current, output)?;
+
+    let result = Command::new("benchstat")
+        .arg(&baseline)
+        .arg(&current)
+        .status();
+    let _ = std::fs::remove_file(&current);
+
+    match result {
+        Ok(_) => Ok(()),
+        Err(err) if err.kind() == io::ErrorKind::NotFound => {
+            eprintln!(
+                "warning: benchstat not found, install it with \
+                 go install golang.org/x/perf/cmd/benchstat@latest"
+            );
+            Ok(())
+        }
+        Err(err) => Err(err.into()),
+    }
+}
+
+fn baseline_path(name: &str) -> Option<PathBuf> {
+    Some(state_dir()?.join("baselines").join(format!("{}.txt", name)))
+}
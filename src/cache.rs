@@ -0,0 +1,63 @@
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::hash::{DefaultHasher, Hash, Hasher};
+use std::path::PathBuf;
+use std::time::SystemTime;
+
+use crate::TestInfo;
+use crate::state::state_dir;
+
+/// Parsed tests keyed by file, reused while the file's mtime is unchanged.
+/// Saved between runs under a key covering everything parsing depends on.
+#[derive(Default, Serialize, Deserialize)]
+pub struct ParseCache {
+    pub files: HashMap<PathBuf, CachedFile>,
+    /// Whether files were parsed or dropped since loading.
+    #[serde(skip)]
+    pub changed: bool,
+}
+
+#[derive(Serialize, Deserialize)]
+pub struct CachedFile {
+    pub modified: SystemTime,
+    pub tests: Vec<TestInfo>,
+}
+
+impl ParseCache {
+    /// Loads the cache saved for `key`, or an empty cache if there is none
+    /// or it cannot be read.
+    pub fn load(key: &str) -> Self {
+        cache_path(key)
+            .and_then(|path| std::fs::read_to_string(path).ok())
+            .and_then(|content| serde_json::from_str(&content).ok())
+            .unwrap_or_default()
+    }
+
+    /// Saves the cache for `key` if it changed since loading.
+    pub fn save(&self, key: &str) -> Result<()> {
+        let Some(path) = cache_path(key) else {
+            return Ok(());
+        };
+        if !self.changed && path.exists() {
+            return Ok(());
+        }
+
+        if let Some(dir) = path.parent() {
+            std::fs::create_dir_all(dir)?;
+        }
+        std::fs::write(path, serde_json::to_string(self)?)?;
+
+        Ok(())
+    }
+}
+
+fn cache_path(key: &str) -> Option<PathBuf> {
+    let mut hasher = DefaultHasher::new();
+    key.hash(&mut hasher);
+
+    state_dir().map(|dir| {
+        dir.join("parse-cache")
+            .join(format!("{:016x}.json", hasher.finish()))
+    })
+}
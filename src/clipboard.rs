@@ -0,0 +1,34 @@
+use anyhow::{Result, bail};
+use std::process::Command;
+
+/// Commands that print the clipboard, tried in order: macOS, Wayland, X11
+/// and Windows.
+const READERS: &[&[&str]] = &[
+    &["pbpaste"],
+    &["wl-paste", "--no-newline"],
+    &["xclip", "-selection", "clipboard", "-o"],
+    &["xsel", "--clipboard", "--output"],
+    &["powershell.exe", "-NoProfile", "-Command", "Get-Clipboard"],
+];
+
+/// Returns the text on the system clipboard, using the first clipboard tool
+/// that runs.
+pub fn read() -> Result<String> {
+    for reader in READERS {
+        let Ok(output) = Command::new(reader[0]).args(&reader[1..]).output() else {
+            continue;
+        };
+        if output.status.success() {
+            return Ok(String::from_utf8_lossy(&output.stdout).to_string());
+        }
+    }
+
+    bail!(
+        "could not read the clipboard, install one of {}",
+        READERS
+            .iter()
+            .map(|reader| reader[0])
+            .collect::<Vec<_>>()
+            .join(", ")
+    )
+}
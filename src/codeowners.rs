@@ -0,0 +1,109 @@
+use std::path::{Component, Path, PathBuf};
+
+use crate::glob::matches_path;
+
+/// The rules of a GitHub CODEOWNERS file, matched against paths relative to
+/// the repository root.
+pub struct CodeOwners {
+    root: PathBuf,
+    rules: Vec<Rule>,
+}
+
+struct Rule {
+    /// Path elements to match, with `**` for any number of them.
+    pattern: Vec<String>,
+    /// Whether the pattern ended in `/` and so only matches directories.
+    directory: bool,
+    /// Whether the pattern also owns what is below a matching directory,
+    /// which GitHub does unless it ends in a wildcard like `docs/*`.
+    descendants: bool,
+    owners: Vec<String>,
+}
+
+impl CodeOwners {
+    /// Reads the CODEOWNERS file of the repository at `root` from the places
+    /// GitHub looks: `.github/`, the root and `docs/`, in that order.
+    pub fn load(root: &Path) -> Option<Self> {
+        let content = [".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"]
+            .iter()
+            .find_map(|file| std::fs::read_to_string(root.join(file)).ok())?;
+
+        Some(CodeOwners {
+            root: root.to_path_buf(),
+            rules: content.lines().filter_map(parse_rule).collect(),
+        })
+    }
+
+    /// Returns the owners of `path` (an absolute, canonical path) from the
+    /// last matching rule, or none when no rule matches or it lists nobody.
+    pub fn owners(&self, path: &Path) -> Vec<String> {
+        let Ok(relative) = path.strip_prefix(&self.root) else {
+            return Vec::new();
+        };
+        let names: Vec<&str> = relative
+            .components()
+            .filter_map(|component| match component {
+                Component::Normal(name) => name.to_str(),
+                _ => None,
+            })
+            .collect();
+
+        self.rules
+            .iter()
+            .rev()
+            .find(|rule| {
+                let pattern: Vec<&str> = rule.pattern.iter().map(String::as_str).collect();
+                let shortest = if rule.descendants { 1 } else { names.len() };
+                let longest = if rule.directory {
+                    names.len().saturating_sub(1)
+                } else {
+                    names.len()
+                };
+                (shortest..=longest).any(|len| matches_path(&pattern, &names[..len]))
+            })
+            .map(|rule| rule.owners.clone())
+            .unwrap_or_default()
+    }
+}
+
+/// Parses a `pattern @owner...` line. Like in .gitignore, a pattern with a
+/// slash at its start or in its middle is relative to the root, others
+/// match at any depth.
+fn parse_rule(line: &str) -> Option<Rule> {
+    let line = line.split_once(" #").map_or(line, |(rule, _)| rule).trim();
+    if line.is_empty() || line.starts_with('#') {
+        return None;
+    }
+
+    let mut fields = line.split_whitespace();
+    let pattern = fields.next()?;
+    let owners = fields.map(str::to_string).collect();
+
+    let directory = pattern.ends_with('/');
+    let trimmed = pattern.trim_end_matches('/');
+    let anchored = trimmed.contains('/');
+    let mut elements: Vec<String> = trimmed
+        .split('/')
+        .filter(|element| !element.is_empty())
+        .map(str::to_string)
+        .collect();
+    if !anchored {
+        elements.insert(0, "**".to_string());
+    }
+    let descendants = elements.last().is_none_or(|last| !last.contains('*'));
+
+    Some(Rule {
+        pattern: elements,
+        directory,
+        descendants,
+        owners,
+    })
+}
+
+/// Returns the root of the git repository containing `dir`, the nearest
+/// ancestor with a `.git` entry.
+pub fn repo_root(dir: &Path) -> Option<PathBuf> {
+    dir.ancestors()
+        .find(|ancestor| ancestor.join(".git").exists())
+        .map(Path::to_path_buf)
+}
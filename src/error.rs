@@ -0,0 +1,55 @@
+use std::fmt;
+use std::io;
+use std::path::{Path, PathBuf};
+
+/// Failures while discovering tests, carrying the path at fault so callers
+/// can tell them apart without parsing messages.
+#[derive(Debug)]
+pub enum DiscoveryError {
+    /// A directory or file could not be walked or stat'ed.
+    Walk {
+        path: PathBuf,
+        source: walkdir::Error,
+    },
+    /// A test file could not be read, e.g. because it is not valid UTF-8.
+    Read { path: PathBuf, source: io::Error },
+}
+
+impl DiscoveryError {
+    pub fn walk(root: &str, source: walkdir::Error) -> Self {
+        let path = source
+            .path()
+            .map_or_else(|| Path::new(root).to_path_buf(), Path::to_path_buf);
+        DiscoveryError::Walk { path, source }
+    }
+
+    pub fn read(path: &Path, source: io::Error) -> Self {
+        DiscoveryError::Read {
+            path: path.to_path_buf(),
+            source,
+        }
+    }
+}
+
+impl fmt::Display for DiscoveryError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            DiscoveryError::Walk { path, source } => match source.io_error() {
+                Some(err) => write!(f, "cannot walk {}: {}", path.display(), err),
+                None => write!(f, "cannot walk {}: {}", path.display(), source),
+            },
+            DiscoveryError::Read { path, source } => {
+                write!(f, "cannot read {}: {}", path.display(), source)
+            }
+        }
+    }
+}
+
+impl std::error::Error for DiscoveryError {
+    fn source(&self) -> Option<&(dyn std::error::Error + 'static)> {
+        match self {
+            DiscoveryError::Walk { source, .. } => Some(source),
+            DiscoveryError::Read { source, .. } => Some(source),
+        }
+    }
+}
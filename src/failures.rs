@@ -0,0 +1,71 @@
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, BTreeSet};
+use std::path::PathBuf;
+
+use crate::affected::canonical;
+use crate::gotest::TestEvent;
+use crate::state::state_dir;
+
+/// The tests and subtests whose most recent run failed, keyed by working
+/// directory, then package import path, with names as go test reports them.
+#[derive(Default, Serialize, Deserialize)]
+pub struct Failures {
+    dirs: BTreeMap<String, BTreeMap<String, BTreeSet<String>>>,
+}
+
+impl Failures {
+    /// Loads the failures file, or no failures if there is none yet.
+    pub fn load() -> Self {
+        failures_path()
+            .and_then(|path| std::fs::read_to_string(path).ok())
+            .and_then(|content| serde_json::from_str(&content).ok())
+            .unwrap_or_default()
+    }
+
+    /// Returns the failed tests of runs in the current directory by package.
+    pub fn current(&self) -> BTreeMap<String, BTreeSet<String>> {
+        self.dirs.get(&current_dir()).cloned().unwrap_or_default()
+    }
+
+    /// Adds the failed tests in `events` and forgets the ones that passed or
+    /// were skipped.
+    pub fn record(events: &[TestEvent]) -> Result<()> {
+        let Some(path) = failures_path() else {
+            return Ok(());
+        };
+
+        let mut failures = Failures::load();
+        let packages = failures.dirs.entry(current_dir()).or_default();
+
+        for event in events {
+            let Some(test) = &event.test else {
+                continue;
+            };
+            let failed = packages.entry(event.package.clone()).or_default();
+            if event.action == "fail" {
+                failed.insert(test.clone());
+            } else {
+                failed.remove(test);
+            }
+        }
+        packages.retain(|_, failed| !failed.is_empty());
+
+        if let Some(dir) = path.parent() {
+            std::fs::create_dir_all(dir)?;
+        }
+        std::fs::write(path, serde_json::to_string(&failures)?)?;
+
+        Ok(())
+    }
+}
+
+fn current_dir() -> String {
+    std::env::current_dir()
+        .map(|dir| canonical(&dir).to_string_lossy().to_string())
+        .unwrap_or_default()
+}
+
+fn failures_path() -> Option<PathBuf> {
+    state_dir().map(|dir| dir.join("failures.json"))
+}
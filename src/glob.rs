@@ -0,0 +1,240 @@
+use anyhow::{Result, bail};
+use std::path::{Component, PathBuf};
+use walkdir::WalkDir;
+
+use crate::affected::canonical;
+
+/// Reports whether a directory argument is a glob pattern rather than a path.
+pub fn is_glob(pattern: &str) -> bool {
+    pattern.contains(['*', '?', '['])
+}
+
+/// Returns the leading directories of `pattern` that contain no glob syntax,
+/// e.g. `./internal` for `./internal/**/db`.
+pub fn base(pattern: &str) -> &str {
+    split(pattern).0
+}
+
+/// Splits a pattern into its base directory and the glob relative to it.
+fn split(pattern: &str) -> (&str, &str) {
+    if !is_glob(pattern) {
+        return (pattern, "");
+    }
+
+    let end = pattern
+        .split('/')
+        .take_while(|part| !is_glob(part))
+        .map(|part| part.len() + 1)
+        .sum::<usize>();
+
+    let base = match pattern[..end.saturating_sub(1)].trim_end_matches('/') {
+        "" if pattern.starts_with('/') => "/",
+        "" => ".",
+        base => base,
+    };
+    (base, &pattern[end.min(pattern.len())..])
+}
+
+/// Returns the directories to search for a directory argument: the directory
+/// itself, or the directories matching a glob pattern where `*`, `?` and
+/// `[...]` match within a path element and `**` matches any number of them.
+/// Matches inside another match are left out, since walks are recursive.
+pub fn search_roots(dir: &str) -> Result<Vec<PathBuf>> {
+    if !is_glob(dir) {
+        return Ok(vec![PathBuf::from(dir)]);
+    }
+
+    let (base, rest) = split(dir);
+    let pattern: Vec<&str> = rest.split('/').filter(|part| !part.is_empty()).collect();
+
+    let mut roots: Vec<PathBuf> = Vec::new();
+
+    for entry in WalkDir::new(base).sort_by_file_name() {
+        let Ok(entry) = entry else {
+            continue;
+        };
+        if !entry.file_type().is_dir() {
+            continue;
+        }
+
+        let relative = entry.path().strip_prefix(base).unwrap_or(entry.path());
+        let names: Vec<String> = relative
+            .components()
+            .filter_map(|component| match component {
+                Component::Normal(name) => Some(name.to_string_lossy().into_owned()),
+                _ => None,
+            })
+            .collect();
+        let names: Vec<&str> = names.iter().map(String::as_str).collect();
+
+        if matches_path(&pattern, &names)
+            && !roots.iter().any(|root| entry.path().starts_with(root))
+        {
+            roots.push(entry.into_path());
+        }
+    }
+
+    if roots.is_empty() {
+        bail!("no directories match {}", dir);
+    }
+
+    Ok(roots)
+}
+
+/// Returns the search roots of several directory arguments, leaving out
+/// repeated roots and roots inside another one. Roots are compared by their
+/// resolved paths, so `.`, `./` and symlinks to the same directory overlap.
+pub fn distinct_roots(dirs: &[&str]) -> Result<Vec<PathBuf>> {
+    let mut roots: Vec<(PathBuf, PathBuf)> = Vec::new();
+
+    for dir in dirs {
+        for root in search_roots(dir)? {
+            let resolved = canonical(&root);
+            if roots.iter().any(|(_, other)| resolved.starts_with(other)) {
+                continue;
+            }
+
+            roots.retain(|(_, other)| !other.starts_with(&resolved));
+            roots.push((root, resolved));
+        }
+    }
+
+    Ok(roots.into_iter().map(|(root, _)| root).collect())
+}
+
+pub fn matches_path(pattern: &[&str], names: &[&str]) -> bool {
+    match pattern.split_first() {
+        None => names.is_empty(),
+        Some((&"**", rest)) => {
+            matches_path(rest, names) || (!names.is_empty() && matches_path(pattern, &names[1..]))
+        }
+        Some((first, rest)) => names.split_first().is_some_and(|(name, names)| {
+            matches_name(first.as_bytes(), name.as_bytes()) && matches_path(rest, names)
+        }),
+    }
+}
+
+/// Matches one path element against `*`, `?` and `[...]` (with `!` or `^`
+/// negation and `a-z` ranges).
+fn matches_name(pattern: &[u8], name: &[u8]) -> bool {
+    match pattern.split_first() {
+        None => name.is_empty(),
+        Some((b'*', rest)) => (0..=name.len()).any(|skip| matches_name(rest, &name[skip..])),
+        Some((b'?', rest)) => !name.is_empty() && matches_name(rest, &name[1..]),
+        Some((b'[', rest)) => {
+            let Some(close) = rest.iter().skip(1).position(|&c| c == b']').map(|i| i + 1) else {
+                return name.first() == Some(&b'[') && matches_name(rest, &name[1..]);
+            };
+            let Some(&c) = name.first() else {
+                return false;
+            };
+
+            let (negated, class) = match rest[0] {
+                b'!' | b'^' => (true, &rest[1..close]),
+                _ => (false, &rest[..close]),
+            };
+            let mut found = false;
+            let mut i = 0;
+            while i < class.len() {
+                if i + 2 < class.len() && class[i + 1] == b'-' {
+                    found |= class[i] <= c && c <= class[i + 2];
+                    i += 3;
+                } else {
+                    found |= class[i] == c;
+                    i += 1;
+                }
+            }
+
+            found != negated && matches_name(&rest[close + 1..], &name[1..])
+        }
+        Some((&c, rest)) => name.first() == Some(&c) && matches_name(rest, &name[1..]),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::path::Path;
+
+    /// Creates an empty directory for one test under the system temp
+    /// directory, removing what an earlier run left there.
+    fn scratch(name: &str) -> PathBuf {
+        let dir =
+            std::env::temp_dir().join(format!("gotestfinder-{}-{}", name, std::process::id()));
+        let _ = std::fs::remove_dir_all(&dir);
+        std::fs::create_dir_all(&dir).unwrap();
+        dir
+    }
+
+    #[test]
+    fn distinct_roots_drops_a_root_inside_an_earlier_one() {
+        let dir = scratch("nested");
+        std::fs::create_dir_all(dir.join("internal")).unwrap();
+        let root = format!("{}/.", dir.display());
+        let internal = format!("{}/./internal", dir.display());
+
+        assert_eq!(
+            distinct_roots(&[&root, &internal]).unwrap(),
+            [Path::new(&root)]
+        );
+        assert_eq!(
+            distinct_roots(&[&root, &format!("{}/", dir.display())]).unwrap(),
+            [Path::new(&root)]
+        );
+        std::fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn distinct_roots_drops_an_earlier_root_inside_a_later_one() {
+        let dir = scratch("containing");
+        std::fs::create_dir_all(dir.join("internal/db")).unwrap();
+        let root = format!("{}/.", dir.display());
+        let db = format!("{}/internal/db", dir.display());
+        let internal = format!("{}/./internal", dir.display());
+
+        assert_eq!(
+            distinct_roots(&[&db, &internal]).unwrap(),
+            [Path::new(&internal)]
+        );
+        assert_eq!(
+            distinct_roots(&[&db, &internal, &root]).unwrap(),
+            [Path::new(&root)]
+        );
+        std::fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn distinct_roots_keeps_separate_roots_in_order() {
+        let dir = scratch("separate");
+        std::fs::create_dir_all(dir.join("b")).unwrap();
+        std::fs::create_dir_all(dir.join("a")).unwrap();
+        let b = dir.join("b").to_string_lossy().into_owned();
+        let a = dir.join("a").to_string_lossy().into_owned();
+
+        assert_eq!(
+            distinct_roots(&[&b, &a]).unwrap(),
+            [PathBuf::from(&b), PathBuf::from(&a)]
+        );
+        std::fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn distinct_roots_resolves_symlinks_into_the_tree() {
+        let dir = scratch("symlink");
+        std::fs::create_dir_all(dir.join("tree/pkg")).unwrap();
+        std::os::unix::fs::symlink(dir.join("tree/pkg"), dir.join("link")).unwrap();
+        let tree = dir.join("tree").to_string_lossy().into_owned();
+        let link = dir.join("link").to_string_lossy().into_owned();
+
+        assert_eq!(
+            distinct_roots(&[&tree, &link]).unwrap(),
+            [PathBuf::from(&tree)]
+        );
+        assert_eq!(
+            distinct_roots(&[&link, &tree]).unwrap(),
+            [PathBuf::from(&tree)]
+        );
+        std::fs::remove_dir_all(dir).unwrap();
+    }
+}
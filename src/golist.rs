@@ -0,0 +1,134 @@
+use anyhow::{Result, bail};
+use std::collections::{BTreeMap, HashMap};
+use std::path::PathBuf;
+use std::process::Command;
+
+use crate::affected::canonical;
+
+/// Asks the go tool which tests, benchmarks, fuzz targets and examples each
+/// package under `dir` really has, keyed by canonical package directory.
+/// Packages that fail to build are left out.
+pub fn list_tests(dir: &str, tags: Option<&str>) -> Result<BTreeMap<PathBuf, Vec<String>>> {
+    let dirs = package_dirs(dir, tags)?;
+
+    let mut cmd = Command::new("go");
+    cmd.args(["test", "-list", "."]);
+    if let Some(tags_value) = tags {
+        cmd.arg(format!("-tags={}", tags_value));
+    }
+    cmd.arg("./...").current_dir(dir);
+
+    // A package that fails to build makes go test exit non-zero, but the
+    // others are still listed, so the exit status is not checked here.
+    let output = cmd.output()?;
+    let stdout = String::from_utf8_lossy(&output.stdout);
+
+    let mut listed = BTreeMap::new();
+    let mut names = Vec::new();
+
+    for line in stdout.lines() {
+        if line.starts_with("ok ") {
+            let import_path = line.split_whitespace().nth(1).unwrap_or("");
+            if let Some(pkg_dir) = dirs.get(import_path) {
+                listed.insert(pkg_dir.clone(), std::mem::take(&mut names));
+            }
+            names.clear();
+        } else if line.starts_with("FAIL") || line.starts_with('?') {
+            names.clear();
+        } else if is_test_name(line) {
+            names.push(line.to_string());
+        }
+    }
+
+    Ok(listed)
+}
+
+fn is_test_name(line: &str) -> bool {
+    ["Test", "Benchmark", "Fuzz", "Example"]
+        .iter()
+        .any(|prefix| line.starts_with(prefix))
+        && line.chars().all(|c| c.is_alphanumeric() || c == '_')
+}
+
+fn package_dirs(dir: &str, tags: Option<&str>) -> Result<HashMap<String, PathBuf>> {
+    let mut cmd = Command::new("go");
+    cmd.args(["list", "-e"]);
+    if let Some(tags_value) = tags {
+        cmd.arg(format!("-tags={}", tags_value));
+    }
+    cmd.args(["-f", "{{.ImportPath}}\t{{.Dir}}", "./..."])
+        .current_dir(dir);
+
+    let output = cmd.output()?;
+    if !output.status.success() {
+        bail!("{}", String::from_utf8_lossy(&output.stderr).trim());
+    }
+
+    Ok(String::from_utf8_lossy(&output.stdout)
+        .lines()
+        .filter_map(|line| line.split_once('\t'))
+        .map(|(import_path, pkg_dir)| (import_path.to_string(), canonical(pkg_dir.as_ref())))
+        .collect())
+}
+
+/// Orders the package directories `dirs` so that each comes after the ones
+/// it imports, directly or not, keeping alphabetical order otherwise.
+pub fn dependency_order<'a>(dirs: &[&'a str], tags: Option<&str>) -> Result<Vec<&'a str>> {
+    let mut cmd = Command::new("go");
+    cmd.args(["list", "-e"]);
+    if let Some(tags_value) = tags {
+        cmd.arg(format!("-tags={}", tags_value));
+    }
+    cmd.args(["-f", "{{.Dir}}\t{{.ImportPath}}\t{{join .Deps \" \"}}"])
+        .args(dirs);
+
+    let output = cmd.output()?;
+    if !output.status.success() {
+        bail!("{}", String::from_utf8_lossy(&output.stderr).trim());
+    }
+    let stdout = String::from_utf8_lossy(&output.stdout);
+
+    let mut listed = HashMap::new();
+    for line in stdout.lines() {
+        let mut fields = line.split('\t');
+        let (Some(pkg_dir), Some(import_path), Some(deps)) =
+            (fields.next(), fields.next(), fields.next())
+        else {
+            continue;
+        };
+        listed.insert(
+            canonical(pkg_dir.as_ref()),
+            (import_path, deps.split_whitespace().collect::<Vec<_>>()),
+        );
+    }
+
+    let mut import_paths = Vec::new();
+    let mut deps = Vec::new();
+    for dir in dirs {
+        let Some((import_path, package_deps)) = listed.remove(&canonical(dir.as_ref())) else {
+            bail!("go list did not report the package in {}", dir);
+        };
+        import_paths.push(import_path);
+        deps.push(package_deps);
+    }
+
+    let mut remaining: Vec<usize> = (0..dirs.len()).collect();
+    remaining.sort_by_key(|&index| dirs[index]);
+    let mut order = Vec::new();
+
+    while !remaining.is_empty() {
+        // The first package none of whose dependencies still waits; go
+        // forbids import cycles, but take the first one should there be any.
+        let position = remaining
+            .iter()
+            .position(|&index| {
+                !remaining
+                    .iter()
+                    .any(|&other| deps[index].contains(&import_paths[other]))
+            })
+            .unwrap_or(0);
+        order.push(dirs[remaining.remove(position)]);
+    }
+
+    Ok(order)
+}
@@ -0,0 +1,108 @@
+use std::path::{Component, Path, PathBuf};
+use std::sync::OnceLock;
+
+use crate::affected::canonical;
+
+/// Derives the import path of the package in `dir` from the nearest `go.mod`.
+pub fn import_path(dir: &Path) -> Option<String> {
+    let dir = canonical(dir);
+
+    for root in dir.ancestors() {
+        let Ok(go_mod) = std::fs::read_to_string(root.join("go.mod")) else {
+            continue;
+        };
+
+        let module = module_path(&go_mod)?;
+        let relative = dir.strip_prefix(root).ok()?;
+
+        if relative.as_os_str().is_empty() {
+            return Some(module);
+        }
+
+        let relative: Vec<_> = relative
+            .components()
+            .map(|component| component.as_os_str().to_string_lossy())
+            .collect();
+        return Some(format!("{}/{}", module, relative.join("/")));
+    }
+
+    module_cache_import_path(&dir)
+}
+
+/// Returns the module cache directory, `$GOMODCACHE` or `pkg/mod` in the
+/// first `$GOPATH` entry (by default `~/go`), as the go command would.
+pub fn module_cache() -> Option<&'static Path> {
+    static MODULE_CACHE: OnceLock<Option<PathBuf>> = OnceLock::new();
+
+    MODULE_CACHE
+        .get_or_init(|| {
+            let dir = std::env::var_os("GOMODCACHE")
+                .filter(|dir| !dir.is_empty())
+                .map(PathBuf::from)
+                .or_else(|| {
+                    let gopath = std::env::var_os("GOPATH").filter(|path| !path.is_empty());
+                    let gopath = match gopath {
+                        Some(gopath) => std::env::split_paths(&gopath).next()?,
+                        None => PathBuf::from(std::env::var_os("HOME")?).join("go"),
+                    };
+                    Some(gopath.join("pkg").join("mod"))
+                })?;
+            Some(canonical(&dir))
+        })
+        .as_deref()
+}
+
+/// Reports whether `path` is inside the module cache, where files are
+/// read-only and never change.
+pub fn in_module_cache(path: &Path) -> bool {
+    module_cache().is_some_and(|cache| canonical(path).starts_with(cache))
+}
+
+/// Derives an import path from a directory's location in the module cache,
+/// `<module>@<version>/<package>`, for modules without a go.mod file.
+/// Upper case letters are stored as `!` and the lower case letter there.
+fn module_cache_import_path(dir: &Path) -> Option<String> {
+    let relative = dir.strip_prefix(module_cache()?).ok()?;
+    let mut elements = Vec::new();
+    let mut versioned = false;
+
+    for component in relative.components() {
+        let Component::Normal(name) = component else {
+            return None;
+        };
+        let name = name.to_str()?;
+        match name.split_once('@') {
+            Some((name, _version)) if !versioned => {
+                elements.push(name);
+                versioned = true;
+            }
+            _ => elements.push(name),
+        }
+    }
+
+    if !versioned || elements.first() == Some(&"cache") {
+        return None;
+    }
+
+    let escaped = elements.join("/");
+    let mut import_path = String::new();
+    let mut chars = escaped.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            '!' => import_path.extend(chars.next().map(|c| c.to_ascii_uppercase())),
+            c => import_path.push(c),
+        }
+    }
+
+    Some(import_path)
+}
+
+fn module_path(go_mod: &str) -> Option<String> {
+    go_mod.lines().find_map(|line| {
+        let module = line.trim().strip_prefix("module")?;
+        if !module.starts_with([' ', '\t']) {
+            return None;
+        }
+        Some(module.trim().trim_matches('"').to_string())
+    })
+}
@@ -0,0 +1,401 @@
+use anyhow::Result;
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::io::{self, BufRead, BufReader, Read, Write};
+use std::process::{Command, ExitStatus, Stdio};
+
+/// A `go test -json` event, see `go doc test2json`.
+#[derive(Debug, Clone, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+pub struct TestEvent {
+    pub action: String,
+    #[serde(default)]
+    pub package: String,
+    pub test: Option<String>,
+    pub elapsed: Option<f64>,
+    pub output: Option<String>,
+}
+
+pub struct RunOutcome {
+    pub status: ExitStatus,
+    /// The pass, fail and skip events of individual tests.
+    pub results: Vec<TestEvent>,
+}
+
+/// Runs a `go test -json` command, printing its output the way plain
+/// `go test` (or `go test -v` when `verbose`) would, and collects the results.
+/// With `raw`, the JSON events are printed unchanged instead. With
+/// `summary_only`, only the output of failed tests and packages is printed.
+pub fn run_json(
+    mut cmd: Command,
+    verbose: bool,
+    raw: bool,
+    summary_only: bool,
+) -> Result<RunOutcome> {
+    cmd.stdout(Stdio::piped());
+
+    let mut child = cmd.spawn()?;
+    let stdout = child.stdout.take().expect("stdout is piped");
+    let results = render_json(stdout, verbose, raw, summary_only)?;
+
+    Ok(RunOutcome {
+        status: child.wait()?,
+        results,
+    })
+}
+
+/// Renders `go test -json` output read from `json` like [`run_json`] does,
+/// returning the results.
+pub fn render_json(
+    json: impl Read,
+    verbose: bool,
+    raw: bool,
+    summary_only: bool,
+) -> Result<Vec<TestEvent>> {
+    render_json_to(json, &mut io::stdout(), verbose, raw, summary_only)
+}
+
+/// Renders `go test -json` output like [`render_json`], writing it to `out`.
+fn render_json_to(
+    json: impl Read,
+    out: &mut impl Write,
+    verbose: bool,
+    raw: bool,
+    summary_only: bool,
+) -> Result<Vec<TestEvent>> {
+    let mut renderer = Renderer {
+        verbose: verbose && !summary_only,
+        summary_only,
+        buffered: HashMap::new(),
+        package_output: HashMap::new(),
+    };
+    let mut results = Vec::new();
+
+    for line in BufReader::new(json).lines() {
+        let line = line?;
+
+        match serde_json::from_str::<TestEvent>(&line) {
+            Ok(event) => {
+                if raw {
+                    writeln!(out, "{}", line)?;
+                } else {
+                    renderer.render(&event, out)?;
+                }
+                if event.test.is_some() && matches!(event.action.as_str(), "pass" | "fail" | "skip")
+                {
+                    results.push(event);
+                }
+            }
+            Err(_) => writeln!(out, "{}", line)?,
+        }
+    }
+
+    Ok(results)
+}
+
+/// Runs a `go test -json` command with its output piped into the shell
+/// command `pipe` instead of printed: the `go test -v` text the events
+/// carry, or with `raw` the JSON events themselves. Collects the results
+/// like [`run_json`]; the status is go test's, a failing pipe only warns.
+pub fn pipe_json(mut cmd: Command, pipe: &str, raw: bool) -> Result<RunOutcome> {
+    let mut sink = Command::new("sh")
+        .args(["-c", pipe])
+        .stdin(Stdio::piped())
+        .spawn()?;
+    let mut input = sink.stdin.take().expect("stdin is piped");
+
+    cmd.stdout(Stdio::piped());
+    let mut child = cmd.spawn()?;
+    let stdout = child.stdout.take().expect("stdout is piped");
+    let mut results = Vec::new();
+    // Once the pipe stops reading, keep draining go test so it can finish.
+    let mut open = true;
+
+    for line in BufReader::new(stdout).lines() {
+        let line = line?;
+        let event = serde_json::from_str::<TestEvent>(&line).ok();
+
+        let text = match &event {
+            Some(_) if raw => format!("{}\n", line),
+            Some(event) => event.output.clone().unwrap_or_default(),
+            None => format!("{}\n", line),
+        };
+        if open && input.write_all(text.as_bytes()).is_err() {
+            open = false;
+        }
+
+        if let Some(event) = event
+            && event.test.is_some()
+            && matches!(event.action.as_str(), "pass" | "fail" | "skip")
+        {
+            results.push(event);
+        }
+    }
+    drop(input);
+
+    let status = child.wait()?;
+    let sink_status = sink.wait()?;
+    if !sink_status.success() {
+        eprintln!("warning: --pipe command {:?} failed: {}", pipe, sink_status);
+    }
+
+    Ok(RunOutcome { status, results })
+}
+
+/// Prints a one-line count of the test results, followed by the failed tests.
+pub fn print_summary(results: &[TestEvent]) {
+    let count = |action: &str| results.iter().filter(|e| e.action == action).count();
+    let failed: Vec<&str> = results
+        .iter()
+        .filter(|event| event.action == "fail")
+        .filter_map(|event| event.test.as_deref())
+        .collect();
+
+    println!(
+        "{}: {} passed, {} failed, {} skipped",
+        if failed.is_empty() { "PASS" } else { "FAIL" },
+        count("pass"),
+        failed.len(),
+        count("skip")
+    );
+    for test in failed {
+        println!("    {}", test);
+    }
+}
+
+struct Renderer {
+    verbose: bool,
+    summary_only: bool,
+    /// Output of running top-level tests (and their subtests) per package,
+    /// only shown if the test fails, like go test does without -v.
+    buffered: HashMap<(String, String), Vec<(String, String)>>,
+    /// Package-level output held back with `summary_only` until the package
+    /// result is known.
+    package_output: HashMap<String, Vec<String>>,
+}
+
+impl Renderer {
+    fn render(&mut self, event: &TestEvent, out: &mut impl Write) -> io::Result<()> {
+        if self.verbose {
+            if let Some(output) = &event.output {
+                write!(out, "{}", output)?;
+            }
+            return Ok(());
+        }
+
+        match (event.test.as_deref(), event.action.as_str()) {
+            (Some(test), "output") => {
+                let output = event.output.as_deref().unwrap_or("");
+                if !output.starts_with("=== ") {
+                    self.buffered
+                        .entry((event.package.clone(), top_level(test).to_string()))
+                        .or_default()
+                        .push((test.to_string(), output.to_string()));
+                }
+            }
+            (Some(test), "fail") if top_level(test) == test => {
+                if let Some(lines) = self
+                    .buffered
+                    .remove(&(event.package.clone(), test.to_string()))
+                {
+                    print_failure(test, &lines, 0, out)?;
+                }
+            }
+            (Some(test), "pass" | "skip") if top_level(test) == test => {
+                self.buffered
+                    .remove(&(event.package.clone(), test.to_string()));
+            }
+            (None, "fail") if self.summary_only => {
+                for output in self
+                    .package_output
+                    .remove(&event.package)
+                    .unwrap_or_default()
+                {
+                    write!(out, "{}", output)?;
+                }
+            }
+            (None, _) if self.summary_only => {
+                if let Some(output) = &event.output {
+                    self.package_output
+                        .entry(event.package.clone())
+                        .or_default()
+                        .push(output.clone());
+                }
+            }
+            (None, _) => {
+                if let Some(output) = &event.output
+                    && output != "PASS\n"
+                    && !output.starts_with("testing: warning: no tests to run")
+                {
+                    write!(out, "{}", output)?;
+                }
+            }
+            _ => {}
+        }
+
+        Ok(())
+    }
+}
+
+/// Prints a failed test's result line and output followed by its failed
+/// subtests, indented by depth. test2json reports subtest results before their
+/// parent's and without indentation, so this restores go test's layout.
+fn print_failure(
+    test: &str,
+    lines: &[(String, String)],
+    depth: usize,
+    out: &mut impl Write,
+) -> io::Result<()> {
+    let indent = "    ".repeat(depth);
+    let own = lines.iter().filter(|(name, _)| name == test);
+
+    for (_, output) in own.clone().filter(|(_, output)| is_result_line(output)) {
+        write!(out, "{}{}", indent, output.trim_start())?;
+    }
+    for (_, output) in own.filter(|(_, output)| !is_result_line(output)) {
+        write!(out, "{}{}", indent, output)?;
+    }
+
+    let mut children: Vec<&str> = Vec::new();
+    for (name, output) in lines {
+        let is_child = name
+            .strip_prefix(test)
+            .and_then(|rest| rest.strip_prefix('/'))
+            .is_some_and(|rest| !rest.contains('/'));
+
+        if is_child
+            && output.trim_start().starts_with("--- FAIL")
+            && !children.contains(&name.as_str())
+        {
+            children.push(name);
+        }
+    }
+
+    for child in children {
+        print_failure(child, lines, depth + 1, out)?;
+    }
+
+    Ok(())
+}
+
+fn is_result_line(output: &str) -> bool {
+    output.trim_start().starts_with("--- ")
+}
+
+fn top_level(test: &str) -> &str {
+    test.split('/').next().unwrap_or(test)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Renders the recorded `go test -json` stream testdata/gotest/NAME,
+    /// returning the text and the results.
+    fn render(name: &str, verbose: bool, summary_only: bool) -> (String, Vec<TestEvent>) {
+        let path = format!("{}/testdata/gotest/{}", env!("CARGO_MANIFEST_DIR"), name);
+        let json = std::fs::read(path).unwrap();
+        let mut out = Vec::new();
+        let results =
+            render_json_to(json.as_slice(), &mut out, verbose, false, summary_only).unwrap();
+
+        (String::from_utf8(out).unwrap(), results)
+    }
+
+    fn results(events: &[TestEvent]) -> Vec<(&str, &str)> {
+        events
+            .iter()
+            .map(|event| (event.test.as_deref().unwrap(), event.action.as_str()))
+            .collect()
+    }
+
+    #[test]
+    fn nested_subtest_failure() {
+        let (text, events) = render("nested_failure.json", false, false);
+
+        assert_eq!(
+            text,
+            "--- FAIL: TestParse (0.00s)\n\
+             \x20   nested_test.go:6: parsing\n\
+             \x20   --- FAIL: TestParse/invalid (0.00s)\n\
+             \x20       --- FAIL: TestParse/invalid/empty (0.00s)\n\
+             \x20           nested_test.go:10: want an error, got nil\n\
+             FAIL\n\
+             FAIL\texample.com/rec/nested\t0.003s\n"
+        );
+        assert_eq!(
+            results(&events),
+            [
+                ("TestParse/valid", "pass"),
+                ("TestParse/invalid/empty", "fail"),
+                ("TestParse/invalid", "fail"),
+                ("TestParse", "fail"),
+                ("TestFormat", "pass"),
+            ]
+        );
+    }
+
+    #[test]
+    fn parallel_tests_keep_their_output_apart() {
+        let (text, events) = render("parallel.json", false, false);
+
+        assert_eq!(
+            text,
+            "--- FAIL: TestSlow (0.05s)\n\
+             \x20   parallel_test.go:10: slow start\n\
+             \x20   parallel_test.go:12: slow failed\n\
+             FAIL\n\
+             FAIL\texample.com/rec/parallel\t0.051s\n"
+        );
+        assert_eq!(
+            results(&events),
+            [("TestFast", "pass"), ("TestSlow", "fail")]
+        );
+    }
+
+    #[test]
+    fn verbose_output_is_printed_as_it_arrives() {
+        let (text, _) = render("parallel.json", true, false);
+        let lines: Vec<&str> = text.lines().collect();
+
+        assert_eq!(lines[0], "=== RUN   TestSlow");
+        let position = |line: &str| lines.iter().position(|l| *l == line).unwrap();
+        assert!(
+            position("    parallel_test.go:17: fast start")
+                < position("    parallel_test.go:12: slow failed")
+        );
+        assert!(position("--- PASS: TestFast (0.02s)") < position("--- FAIL: TestSlow (0.05s)"));
+    }
+
+    #[test]
+    fn build_failure() {
+        let (text, events) = render("build_failure.json", false, false);
+
+        assert_eq!(
+            text,
+            "# example.com/rec/broken [example.com/rec/broken.test]\n\
+             broken/broken_test.go:6:2: undefined: undefined\n\
+             FAIL\texample.com/rec/broken [build failed]\n"
+        );
+        assert!(events.is_empty());
+    }
+
+    #[test]
+    fn package_without_tests() {
+        let (text, events) = render("no_tests.json", false, false);
+
+        assert_eq!(text, "?   \texample.com/rec/empty\t[no test files]\n");
+        assert!(events.is_empty());
+
+        let (text, _) = render("no_tests.json", false, true);
+        assert_eq!(text, "");
+    }
+
+    #[test]
+    fn summary_only_prints_failures() {
+        let (text, _) = render("nested_failure.json", false, true);
+
+        assert!(text.starts_with("--- FAIL: TestParse (0.00s)\n"));
+        assert!(text.ends_with("FAIL\nFAIL\texample.com/rec/nested\t0.003s\n"));
+    }
+}
@@ -0,0 +1,135 @@
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+
+use crate::gotest::TestEvent;
+use crate::state::state_dir;
+
+/// Durations in seconds of the most recent run of each test and subtest,
+/// keyed by package import path and then test name.
+#[derive(Default, Serialize, Deserialize)]
+pub struct History {
+    packages: BTreeMap<String, BTreeMap<String, f64>>,
+}
+
+impl History {
+    /// Loads the history file, or an empty history if there is none yet.
+    pub fn load() -> Self {
+        history_path()
+            .map(|path| History::load_from(&path))
+            .unwrap_or_default()
+    }
+
+    fn load_from(path: &Path) -> Self {
+        std::fs::read_to_string(path)
+            .ok()
+            .and_then(|content| serde_json::from_str(&content).ok())
+            .unwrap_or_default()
+    }
+
+    pub fn duration(&self, package: &str, test: &str) -> Option<f64> {
+        self.packages.get(package)?.get(test).copied()
+    }
+
+    /// Stores the durations of the passed and failed tests in `events`.
+    pub fn record(events: &[TestEvent]) -> Result<()> {
+        match history_path() {
+            Some(path) => History::record_to(&path, events),
+            None => Ok(()),
+        }
+    }
+
+    fn record_to(path: &Path, events: &[TestEvent]) -> Result<()> {
+        let mut history = History::load_from(path);
+
+        for event in events {
+            if let (Some(test), Some(elapsed), "pass" | "fail") =
+                (&event.test, event.elapsed, event.action.as_str())
+            {
+                history
+                    .packages
+                    .entry(event.package.clone())
+                    .or_default()
+                    .insert(test.clone(), elapsed);
+            }
+        }
+
+        if let Some(dir) = path.parent() {
+            std::fs::create_dir_all(dir)?;
+        }
+        std::fs::write(path, serde_json::to_string(&history)?)?;
+
+        Ok(())
+    }
+}
+
+fn history_path() -> Option<PathBuf> {
+    state_dir().map(|dir| dir.join("history.json"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn event(action: &str, package: &str, test: Option<&str>, elapsed: Option<f64>) -> TestEvent {
+        TestEvent {
+            action: action.to_string(),
+            package: package.to_string(),
+            test: test.map(str::to_string),
+            elapsed,
+            output: None,
+        }
+    }
+
+    fn scratch(name: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("gotestfinder-history-{}", std::process::id()));
+        let path = dir.join(name).join("history.json");
+        let _ = std::fs::remove_file(&path);
+        path
+    }
+
+    #[test]
+    fn load_without_a_file_is_empty() {
+        let path = scratch("missing");
+
+        assert!(History::load_from(&path).packages.is_empty());
+
+        std::fs::create_dir_all(path.parent().unwrap()).unwrap();
+        std::fs::write(&path, "not json").unwrap();
+        assert!(History::load_from(&path).packages.is_empty());
+    }
+
+    #[test]
+    fn record_keeps_the_latest_durations() {
+        let path = scratch("record");
+
+        History::record_to(
+            &path,
+            &[
+                event("pass", "example.com/a", Some("TestA"), Some(0.5)),
+                event("fail", "example.com/a", Some("TestA/sub"), Some(0.25)),
+                event("skip", "example.com/a", Some("TestSkipped"), Some(0.0)),
+                event("pass", "example.com/b", Some("TestB"), Some(1.5)),
+                event("fail", "example.com/b", None, Some(2.0)),
+            ],
+        )
+        .unwrap();
+        History::record_to(
+            &path,
+            &[event("pass", "example.com/b", Some("TestB"), Some(0.75))],
+        )
+        .unwrap();
+
+        let history = History::load_from(&path);
+        assert_eq!(history.duration("example.com/a", "TestA"), Some(0.5));
+        assert_eq!(history.duration("example.com/a", "TestA/sub"), Some(0.25));
+        assert_eq!(history.duration("example.com/a", "TestSkipped"), None);
+        assert_eq!(history.duration("example.com/b", "TestB"), Some(0.75));
+        assert_eq!(history.duration("example.com/b", "TestC"), None);
+        assert_eq!(
+            history.packages.keys().collect::<Vec<_>>(),
+            ["example.com/a", "example.com/b"]
+        );
+    }
+}
@@ -1,19 +1,64 @@
-use anyhow::Result;
-use clap::Parser;
+mod affected;
+mod bench;
+mod cache;
+mod clipboard;
+mod codeowners;
+mod error;
+mod failures;
+mod glob;
+mod golist;
+mod gomod;
+mod gotest;
+mod history;
+mod manifest;
+mod platform;
+mod skim_args;
+mod state;
+mod yaml;
+
+use anyhow::{Context, Result};
+use clap::{Parser, Subcommand, ValueEnum};
 use regex::Regex;
+use serde::{Deserialize, Serialize};
 use skim::prelude::*;
+use std::cmp::Ordering;
+use std::collections::{BTreeMap, BTreeSet, HashMap, HashSet};
 use std::io::Cursor;
-use std::io::{self, Write};
-use std::path::Path;
-use std::process::Command;
+use std::io::{self, IsTerminal, Write};
+use std::path::{Path, PathBuf};
+use std::process::{Command, ExitStatus};
+use std::sync::{Mutex, OnceLock};
+use std::thread;
+use std::time::{Duration, Instant, SystemTime};
 use walkdir::WalkDir;
 
+use cache::{CachedFile, ParseCache};
+use codeowners::CodeOwners;
+use error::DiscoveryError;
+use failures::Failures;
+use history::History;
+use manifest::Manifest;
+use platform::{BuildContext, TagRules};
+
+/// Version details for bug reports, from the build script.
+const LONG_VERSION: &str = concat!(
+    env!("CARGO_PKG_VERSION"),
+    "\ncommit: ",
+    env!("GOTESTFINDER_COMMIT"),
+    "\nbuilt with: ",
+    env!("GOTESTFINDER_RUSTC"),
+);
+
 #[derive(Parser)]
 #[command(name = "gotestfinder")]
 #[command(about = "Find and run Go tests with fuzzy selection")]
+#[command(version, long_version = LONG_VERSION)]
+#[command(subcommand_negates_reqs = true)]
 struct Args {
-    /// Directory to search for tests
-    directory: String,
+    /// Directories to search for tests; nested and repeated ones are searched
+    /// once
+    #[arg(value_name = "DIRECTORY", required_unless_present_any = ["diff", "lens", "manifest", "from_clipboard"])]
+    directories: Vec<String>,
 
     /// Show individual subtests
     #[arg(long, default_value = "true")]
@@ -23,247 +68,5422 @@ struct Args {
     #[arg(long, default_value = "true")]
     parent: bool,
 
-    /// Use skim for interactive test selection and execution
-    #[arg(long)]
+    /// Use skim for interactive test selection and execution (built in, no
+    /// fzf binary needed)
+    #[arg(long, visible_alias = "tui")]
     fzf: bool,
 
-    /// Build tags to pass to go test
+    /// Build tags to pass to go test; repeat as DIR=TAGS to use different tags
+    /// for the tests under DIR
     #[arg(long)]
-    tags: Option<String>,
+    tags: Vec<String>,
+
+    /// Run the go test -run pattern or the printed patterns on the clipboard,
+    /// without discovering tests
+    #[arg(long, conflicts_with_all = ["fzf", "watch_run", "diff", "lens"])]
+    from_clipboard: bool,
+
+    /// Also search the directories listed in FILE, one per line as
+    /// "DIR [tags=TAGS] [exclude=REGEX]..."
+    #[arg(long, value_name = "FILE")]
+    manifest: Option<String>,
 
     /// Enable verbose output (-v flag for go test)
     #[arg(short, long)]
     verbose: bool,
-}
 
-#[derive(Debug, Clone)]
-struct TestInfo {
-    name: String,
-    #[allow(dead_code)]
-    file: String,
-    #[allow(dead_code)]
-    line: usize,
-    subtests: Vec<String>,
-}
+    /// Report likely mistakes in test files to stderr
+    #[arg(long)]
+    warn: bool,
 
-fn main() -> Result<()> {
-    let args = Args::parse();
+    /// Target operating system for build constraints (defaults to $GOOS or the host)
+    #[arg(long)]
+    goos: Option<String>,
 
-    let tests = find_tests(&args.directory)?;
+    /// Target architecture for build constraints (defaults to $GOARCH or the host)
+    #[arg(long)]
+    goarch: Option<String>,
 
-    if args.fzf {
-        run_with_skim(tests, args.tags, args.verbose)?;
-    } else {
-        print_tests(&tests, args.subtests, args.parent);
-    }
+    /// Treat cgo as enabled for build constraints and go test (overrides $CGO_ENABLED)
+    #[arg(long, conflicts_with = "no_cgo")]
+    cgo: bool,
 
-    Ok(())
-}
+    /// Treat cgo as disabled for build constraints and go test (overrides $CGO_ENABLED)
+    #[arg(long)]
+    no_cgo: bool,
 
-fn find_tests(dir: &str) -> Result<Vec<TestInfo>> {
-    let mut tests = Vec::new();
+    /// Only show tests in packages affected by changes since --base, including
+    /// packages that transitively import a changed package
+    #[arg(long)]
+    affected: bool,
 
-    for entry in WalkDir::new(dir) {
-        let entry = entry?;
-        let path = entry.path();
+    /// Only show tests in files with uncommitted changes, modified, staged or
+    /// untracked, according to git status
+    #[arg(long)]
+    dirty: bool,
 
-        if path.extension().is_some_and(|ext| ext == "go")
-            && path
-                .file_name()
-                .is_some_and(|name| name.to_string_lossy().ends_with("_test.go"))
-        {
-            tests.extend(parse_test_file(path)?);
-        }
-    }
+    /// Git revision to compare against with --affected and --run-changed-subtests
+    #[arg(long, default_value = "HEAD")]
+    base: String,
 
-    Ok(tests)
-}
+    /// Select tests with skim, then rerun them and rediscover tests whenever a
+    /// Go file changes
+    #[arg(long)]
+    watch_run: bool,
 
-fn parse_test_file(path: &Path) -> Result<Vec<TestInfo>> {
-    let content = std::fs::read_to_string(path)?;
-    let mut tests = Vec::new();
+    /// Only pass the packages containing the selected tests to go test,
+    /// instead of ./...
+    #[arg(long)]
+    tidy: bool,
 
-    let test_func_regex = Regex::new(r"func\s+(Test\w+)\s*\([^)]*\*testing\.[TB]\w*\)")?;
-    let subtest_regex = Regex::new(r#"\.Run\s*\(\s*"([^"]+)""#)?;
+    /// Run tests in random order (go test -shuffle)
+    #[arg(long)]
+    shuffle: bool,
 
-    let lines: Vec<&str> = content.lines().collect();
+    /// Seed for --shuffle, to reproduce an order (implies --shuffle)
+    #[arg(long)]
+    shuffle_seed: Option<i64>,
 
-    for (line_num, line) in lines.iter().enumerate() {
-        if let Some(caps) = test_func_regex.captures(line) {
-            let test_name = caps.get(1).unwrap().as_str().to_string();
-            let mut subtests = Vec::new();
+    /// Type-check the packages of the selected tests with go vet before running
+    #[arg(long)]
+    validate: bool,
 
-            let mut brace_count = 0;
-            let mut in_function = false;
+    /// Reconcile parsed tests with the names reported by go test -list
+    #[arg(long)]
+    use_golist: bool,
 
-            for (_, &func_line) in lines.iter().enumerate().skip(line_num) {
-                if func_line.contains('{') {
-                    brace_count += func_line.matches('{').count();
-                    in_function = true;
-                }
-                if func_line.contains('}') {
-                    brace_count = brace_count.saturating_sub(func_line.matches('}').count());
-                }
+    /// List tests in the order go test runs them: packages by import path,
+    /// then tests, fuzz targets, examples and benchmarks, each in file name
+    /// and source order with the external test package last
+    #[arg(long, conflicts_with = "sort")]
+    go_order: bool,
 
-                if in_function && brace_count == 0 {
-                    break;
-                }
+    /// Order the skim list by the durations recorded in previous runs, or by
+    /// the size of the test functions
+    #[arg(long, value_enum)]
+    sort: Option<SortOrder>,
 
-                if in_function {
-                    for caps in subtest_regex.captures_iter(func_line) {
-                        if let Some(subtest_name) = caps.get(1) {
-                            subtests.push(subtest_name.as_str().to_string());
-                        }
-                    }
-                }
-            }
+    /// Initial query to open skim with
+    #[arg(long)]
+    query: Option<String>,
 
-            tests.push(TestInfo {
-                name: test_name,
-                file: path.to_string_lossy().to_string(),
-                line: line_num + 1,
-                subtests,
-            });
-        }
-    }
+    /// Print the raw go test -json output of the run on stdout
+    #[arg(long)]
+    json_run: bool,
 
-    Ok(tests)
+    /// Print the test patterns removed (-) and added (+) going from directory A to B
+    #[arg(long, num_args = 2, value_names = ["A", "B"])]
+    diff: Option<Vec<String>>,
+
+    /// Regex of test patterns (Name or Name/subtest) to leave out; must match
+    /// the whole pattern, can be repeated
+    #[arg(long, value_name = "REGEX")]
+    exclude_test: Vec<String>,
+
+    /// Only read the test files directly in the given directories, not in
+    /// the packages below them
+    #[arg(long)]
+    no_recurse: bool,
+
+    /// Only read test files whose name ends in SUFFIX, e.g.
+    /// _integration_test.go
+    #[arg(long, value_name = "SUFFIX", default_value = "_test.go")]
+    suffix: String,
+
+    /// Skip looking for subtests while parsing, for fast top-level listings
+    #[arg(long)]
+    no_subtests_scan: bool,
+
+    /// Run only the subtests whose lines changed since --base, or the whole
+    /// test when a change is outside of its subtests
+    #[arg(long)]
+    run_changed_subtests: bool,
+
+    /// Print each discovered test as a JSON object on its own line
+    #[arg(long)]
+    ndjson: bool,
+
+    /// Print the discovered tests as one JSON, YAML or TOML document, with
+    /// the same fields as --ndjson
+    #[arg(long, value_enum, conflicts_with = "ndjson")]
+    format: Option<OutputFormat>,
+
+    /// Only show tests in external test packages (package foo_test)
+    #[arg(long, conflicts_with = "internal_only")]
+    external_only: bool,
+
+    /// Only show tests in the package under test (package foo)
+    #[arg(long)]
+    internal_only: bool,
+
+    /// Print the N slowest files to parse (default 10) to stderr
+    #[arg(long, value_name = "N", num_args = 0..=1, default_missing_value = "10")]
+    profile_discovery: Option<usize>,
+
+    /// Run the whole parent test of every selected subtest, including code
+    /// outside its t.Run calls and the other subtests
+    #[arg(long)]
+    expand_to_parent: bool,
+
+    /// Debug the single selected test with `dlv test` in its package
+    /// directory instead of running it
+    #[arg(long, requires = "fzf", conflicts_with_all = ["watch_run", "json_run", "summary_only"])]
+    debug_test: bool,
+
+    /// Pick a test, name a new subtest and insert a t.Run skeleton at the end
+    /// of the test's body, then open $VISUAL or $EDITOR there
+    #[arg(long, conflicts_with_all = ["fzf", "watch_run"])]
+    scaffold: bool,
+
+    /// Report files scanned and tests found on stderr while discovering;
+    /// ignored unless stdout is a terminal and output is for humans
+    #[arg(long)]
+    progress: bool,
+
+    /// Environment variable to set for go test, e.g. GOFLAGS=-mod=mod; can be
+    /// repeated
+    #[arg(long, value_name = "KEY=VALUE")]
+    env: Vec<String>,
+
+    /// Run go test in DIR (relative to the current directory) with go's own
+    /// -C flag, e.g. the module root, while discovering tests as usual
+    #[arg(short = 'C', value_name = "DIR", conflicts_with_all = ["lens", "debug_test"])]
+    chdir: Option<String>,
+
+    /// Run each package of the selection with its own go test, N at a time
+    /// (default GOMAXPROCS or the number of CPUs), printing each package's
+    /// output as a block when it finishes
+    #[arg(long, value_name = "N", num_args = 0..=1, require_equals = true, conflicts_with_all = ["bench", "validate", "debug_test"])]
+    parallel_packages: Option<Option<usize>>,
+
+    /// Show the go test command and number of tests after selecting and ask
+    /// before running them; skipped when stdin is not a terminal
+    #[arg(long, requires = "fzf")]
+    confirm: bool,
+
+    /// After the run, prompt for flag tweaks (toggle -v or -race, change
+    /// -count) and rerun the same selection until q
+    #[arg(long, requires = "fzf", conflicts_with_all = ["debug_test", "bench"])]
+    repl: bool,
+
+    /// Keep running the other packages or batches when one fails or cannot
+    /// be run, and list the failed ones at the end
+    #[arg(long)]
+    keep_going: bool,
+
+    /// Pipe the output of go test into a shell command instead of printing
+    /// it, e.g. 'go-junit-report > report.xml'; it gets go test -v output, or
+    /// the JSON events with --json-run. The exit code is still go test's
+    #[arg(long, value_name = "COMMAND", conflicts_with_all = ["bench", "parallel_packages", "summary_only", "debug_test"])]
+    pipe: Option<String>,
+
+    /// Run the selection in chunks of at most N patterns, one go test after
+    /// the other, to keep -run values of huge selections manageable
+    #[arg(long, value_name = "N")]
+    batch_size: Option<usize>,
+
+    /// Print a copy-pasteable go test command per discovered test, or per
+    /// selected test under --fzf, that runs just it in its package
+    #[arg(long, conflicts_with_all = ["packages", "watch_run", "debug_test", "scaffold"])]
+    as_commands: bool,
+
+    /// Print a run file for custom harnesses: a line per package with
+    /// discovered tests, "PACKAGE<TAB>TAGS<TAB>RUN_PATTERN"
+    #[arg(long, conflicts_with_all = ["fzf", "watch_run", "scaffold"])]
+    gen_testmain: bool,
+
+    /// Print the import paths of the packages with discovered tests, or with
+    /// the selected tests under --fzf, instead of patterns or running them
+    #[arg(long, conflicts_with_all = ["watch_run", "debug_test", "scaffold"])]
+    packages: bool,
+
+    /// Describe on stderr where each printed or run pattern comes from and
+    /// how go test will read it
+    #[arg(long)]
+    explain: bool,
+
+    /// Print and run bare names instead of ^Name$ patterns, so that they
+    /// match any test containing the name like plain go test -run
+    #[arg(long)]
+    no_anchor: bool,
+
+    /// Separator between subtest levels in the printed list; runs always
+    /// use /
+    #[arg(long, value_name = "SEP", default_value = "/")]
+    sep: String,
+
+    /// List the GOOS/GOARCH ports each test builds on instead of filtering by
+    /// platform (as JSON lines with --ndjson)
+    #[arg(long)]
+    list_platforms: bool,
+
+    /// Print a JSON line per test and subtest in FILE with its position and
+    /// the go test command running just it, for editor code lenses
+    #[arg(long, value_name = "FILE", conflicts_with = "directories")]
+    lens: Option<String>,
+
+    /// Comma-separated function name prefixes to treat as tests, e.g.
+    /// Test,Acc; functions must still take a single *testing.T
+    #[arg(long, value_delimiter = ',', default_value = "Test")]
+    prefixes: Vec<String>,
+
+    /// Only print a pass/fail summary of the run, plus the output of failed
+    /// tests and packages
+    #[arg(long, conflicts_with = "json_run")]
+    summary_only: bool,
+
+    /// Fail instead of warning when a directory contains no Go files
+    #[arg(long)]
+    strict: bool,
+
+    /// Print the test files that contain at least one test instead of patterns
+    #[arg(long)]
+    list_files: bool,
+
+    /// Print the package directories with non-test Go files but no
+    /// discovered tests instead of patterns
+    #[arg(long)]
+    untested: bool,
+
+    /// Only show tests whose doc comment declares this tag in a
+    /// `// tags: a, b` line; repeat to require several
+    #[arg(long, value_name = "TAG")]
+    has_tag: Vec<String>,
+
+    /// Only show tests owned by OWNER (e.g. @org/team) according to the
+    /// repository's CODEOWNERS file; can be repeated
+    #[arg(long, value_name = "OWNER")]
+    owner: Vec<String>,
+
+    /// Leave out tests whose first statement is an unconditional t.Skip,
+    /// t.Skipf or t.SkipNow
+    #[arg(long, conflicts_with = "skipped_only")]
+    hide_skipped: bool,
+
+    /// Only show tests whose first statement is an unconditional skip
+    #[arg(long)]
+    skipped_only: bool,
+
+    /// Leave out tests in files with a "// Code generated ... DO NOT EDIT."
+    /// header
+    #[arg(long, conflicts_with = "generated_only")]
+    skip_generated: bool,
+
+    /// Only show tests in generated files
+    #[arg(long)]
+    generated_only: bool,
+
+    /// Only show tests without a doc comment; with --warn, report them as
+    /// warnings instead of filtering
+    #[arg(long, conflicts_with = "only_with_doc")]
+    undocumented: bool,
+
+    /// Only show tests with a doc comment
+    #[arg(long)]
+    only_with_doc: bool,
+
+    /// Leave out functions that start with t.Helper(), helpers that happen
+    /// to be named like tests
+    #[arg(long)]
+    exclude_helpers: bool,
+
+    /// Ignore //testtool:focus directives and consider all tests
+    #[arg(long)]
+    no_focus: bool,
+
+    /// Only show tests with at least N subtests, nested ones included
+    #[arg(long, value_name = "N", conflicts_with = "no_subtests_scan")]
+    min_subtests: Option<usize>,
+
+    /// Run each package of the selection with its own go test, in random order
+    #[arg(long)]
+    shuffle_packages: bool,
+
+    /// Run each package of the selection with its own go test, packages
+    /// before the ones importing them (per go list), so that failures in
+    /// lower layers show first
+    #[arg(long, conflicts_with = "shuffle_packages")]
+    topo_order: bool,
+
+    /// Select and run benchmarks (with -benchmem) instead of tests
+    #[arg(long, conflicts_with_all = ["json_run", "summary_only"])]
+    bench: bool,
+
+    /// Also list benchmarks; selected ones run with -bench next to the tests
+    #[arg(long, conflicts_with = "bench")]
+    include_bench: bool,
+
+    /// Also list fuzz targets, which -run runs on their seed corpus
+    #[arg(long, conflicts_with = "bench")]
+    include_fuzz: bool,
+
+    /// List fuzz targets annotated with the size of their seed corpus in
+    /// testdata/fuzz/NAME; `with` or `without` keeps only the fuzz targets
+    /// that have or lack one
+    #[arg(long, value_enum, value_name = "FILTER", num_args = 0..=1, require_equals = true, default_missing_value = "any", conflicts_with = "bench")]
+    fuzz_corpus: Option<CorpusFilter>,
+
+    /// List tests annotated with the testdata fixtures they read, found as
+    /// string literals mentioning testdata in their bodies
+    #[arg(long)]
+    fixtures: bool,
+
+    /// Also list examples, which -run runs and checks against their output
+    /// comment
+    #[arg(long, conflicts_with = "bench")]
+    include_examples: bool,
+
+    /// Number of times to run each benchmark with --bench
+    #[arg(long, value_name = "N", default_value_t = 6)]
+    bench_count: usize,
+
+    /// Stress the selected tests to surface races and flakiness: run them N
+    /// times with -count=N -race -parallel=N; flags after -- override these
+    #[arg(long, value_name = "N", conflicts_with = "bench")]
+    stress: Option<usize>,
+
+    /// Compare the benchmark results with a saved baseline (default "default")
+    /// using benchstat
+    #[arg(long, value_name = "NAME", num_args = 0..=1, default_missing_value = "default", requires = "bench")]
+    benchstat: Option<String>,
+
+    /// Save the benchmark results as the baseline NAME
+    #[arg(long, value_name = "NAME", requires = "bench")]
+    save_baseline: Option<String>,
+
+    /// Extra fzf-style options for the selector, e.g. "--reverse --bind
+    /// ctrl-p:toggle-preview"; quotes group words like in a shell
+    #[arg(long, value_name = "ARGS", allow_hyphen_values = true)]
+    fzf_args: Option<String>,
+
+    /// Prompt of the selector; {count} and {tags} are replaced by the number
+    /// of candidates and the build tags
+    #[arg(long, value_name = "TEXT")]
+    prompt: Option<String>,
+
+    /// Header line of the selector, with the same placeholders as --prompt
+    #[arg(long, value_name = "TEXT")]
+    header: Option<String>,
+
+    /// Run the tests and subtests that failed in the last run from this
+    /// directory, without the selector
+    #[arg(long, conflicts_with_all = ["fzf", "recent", "watch_run", "run_changed_subtests"])]
+    rerun_failed: bool,
+
+    /// Run the tests of the N most recently modified test files (default 1)
+    #[arg(long, value_name = "N", num_args = 0..=1, default_missing_value = "1")]
+    recent: Option<usize>,
+
+    /// Print test and subtest counts per package as Prometheus metrics
+    #[arg(long)]
+    metrics: bool,
+
+    /// Print one tab-separated line per pattern: pattern, file, line, package
+    /// and kind
+    #[arg(long)]
+    tsv: bool,
+
+    /// Soft memory limit for the tests, passed as GOMEMLIMIT (e.g. 512MiB)
+    #[arg(long, value_name = "LIMIT")]
+    memory_limit: Option<String>,
+
+    /// CPUs to pin go test to with taskset, e.g. 0-1 (Linux only)
+    #[arg(long, value_name = "LIST")]
+    cpus: Option<String>,
+
+    /// Niceness to run go test with (Linux only)
+    #[arg(long, value_name = "N", allow_negative_numbers = true)]
+    nice: Option<i32>,
+
+    /// Offer and print only the subtests of tests that have them, never the
+    /// parent test on its own
+    #[arg(long)]
+    only_subtests: bool,
+
+    /// Extra go test flags, given after `--`, e.g. `-- -vet=off -race`;
+    /// anything from -args on goes to the test binary
+    #[arg(last = true, value_name = "GO_TEST_ARGS")]
+    go_args: Vec<String>,
+
+    #[command(subcommand)]
+    mode: Option<Mode>,
 }
 
-fn print_tests(tests: &[TestInfo], show_subtests: bool, show_parent: bool) {
-    for test in tests {
-        if test.subtests.is_empty() {
-            println!("^{}$", test.name);
+/// Modes that do one thing instead of listing or running tests. Options for
+/// discovery, like --tags, go before the subcommand.
+#[derive(Subcommand)]
+enum Mode {
+    /// Parse everything into the saved parse cache and print how many files
+    /// it holds, so the next run starts fast; e.g. for editors to run on
+    /// project open
+    Warm {
+        /// Directories to parse
+        #[arg(value_name = "DIRECTORY", required = true)]
+        directories: Vec<String>,
+    },
+    /// Compare the parsed top-level tests with those go test -list reports,
+    /// print the ones missed or wrongly found, and exit 1 on a mismatch
+    Verify {
+        /// Directories to check
+        #[arg(value_name = "DIRECTORY", required = true)]
+        directories: Vec<String>,
+    },
+    /// Print the JSON Schema of a discovered test as --ndjson prints it (and
+    /// of the array items of --format json)
+    Schema,
+}
+
+impl Args {
+    fn directories(&self) -> Vec<&str> {
+        if self.directories.is_empty() {
+            vec!["."]
         } else {
-            if show_parent {
-                println!("^{}$", test.name);
-            }
-            if show_subtests {
-                for subtest in &test.subtests {
-                    println!("^{}/{}$", test.name, subtest);
-                }
-            }
+            self.directories.iter().map(String::as_str).collect()
         }
     }
+
+    /// Whether --cgo or --no-cgo was given, and which.
+    fn cgo_override(&self) -> Option<bool> {
+        (self.cgo || self.no_cgo).then_some(self.cgo)
+    }
 }
 
-fn run_with_skim(tests: Vec<TestInfo>, tags: Option<String>, verbose: bool) -> Result<()> {
-    let test_patterns = collect_test_patterns(&tests);
+#[derive(Clone, Copy, ValueEnum)]
+enum SortOrder {
+    Slowest,
+    Fastest,
+    Largest,
+}
 
-    if test_patterns.is_empty() {
-        println!("No tests found");
-        return Ok(());
-    }
+#[derive(Clone, Copy, PartialEq, Eq, ValueEnum)]
+enum CorpusFilter {
+    Any,
+    With,
+    Without,
+}
 
-    let selected_tests = skim_select(&test_patterns)?;
+#[derive(Clone, Copy, ValueEnum)]
+enum OutputFormat {
+    Json,
+    Yaml,
+    Toml,
+}
 
-    if selected_tests.is_empty() {
-        println!("No tests selected");
-        return Ok(());
-    }
+const WATCH_INTERVAL: Duration = Duration::from_millis(500);
+const WATCH_DEBOUNCE: Duration = Duration::from_millis(300);
+const PROGRESS_INTERVAL: Duration = Duration::from_millis(200);
 
-    let run_pattern = build_run_pattern(&selected_tests);
-    execute_go_test(&run_pattern, tags, verbose)?;
+/// The longest -run value passed to go test, well below the limits on a
+/// single argument (128 KiB on Linux) and on the whole command line (32K
+/// characters on Windows).
+const MAX_RUN_PATTERN: usize = if cfg!(windows) { 8_000 } else { 64_000 };
 
-    Ok(())
-}
+/// Shows the case data of a table-driven subtest (field 5, lines separated by
+/// \x1f) if any, then the file of the highlighted test (field 2) around its
+/// line (field 3), marking that line. Uses bat when available.
+const PREVIEW_COMMAND: &str = "if [ -n {5} ]; then printf '%s\\n\\n' {5} | tr '\\037' '\\n'; fi; \
+    bat --color=always --style=numbers --highlight-line {3} {2} 2>/dev/null \
+    || awk -v line={3} '{ printf \"%s%5d  %s\\n\", NR == line ? \">\" : \" \", NR, $0 }' {2}";
 
-fn collect_test_patterns(tests: &[TestInfo]) -> Vec<String> {
-    let mut patterns = Vec::new();
+/// Lines of a table-driven subtest's case data kept for the preview.
+const MAX_CASE_LINES: usize = 12;
 
-    for test in tests {
-        if test.subtests.is_empty() {
-            patterns.push(test.name.clone());
-        } else {
-            patterns.push(test.name.clone());
-            for subtest in &test.subtests {
-                patterns.push(format!("{}/{}", test.name, subtest));
-            }
-        }
-    }
+struct DiscoveryOptions {
+    warn: bool,
+    build: BuildContext,
+    exclude: Vec<Regex>,
+    /// Patterns excluded only under a directory, from --manifest.
+    dir_exclude: Vec<(PathBuf, Regex)>,
+    scan_subtests: bool,
+    profile: Option<usize>,
+    progress: bool,
+    prefixes: Vec<String>,
+    kinds: Vec<Kind>,
+    subtest_patterns: SubtestPatterns,
+    /// Whether to look for tests below the given directories too.
+    recurse: bool,
+    /// File name ending of the test files to read, `_test.go` by default.
+    suffix: String,
+    /// Whether to read test files whatever platform they build on, for
+    /// --list-platforms.
+    any_platform: bool,
+}
 
-    patterns
+#[derive(Clone)]
+struct RunOptions {
+    tags: TagRules,
+    verbose: bool,
+    tidy: bool,
+    shuffle_seed: Option<i64>,
+    /// Seed for running packages one by one in random order.
+    package_seed: Option<i64>,
+    /// Whether to run packages one by one in dependency order.
+    topo_order: bool,
+    validate: bool,
+    sort: Option<SortOrder>,
+    query: Option<String>,
+    json_run: bool,
+    summary_only: bool,
+    env: Vec<(String, String)>,
+    anchor: bool,
+    /// How often to run each benchmark, set when running benchmarks.
+    bench_count: Option<usize>,
+    stress: Option<usize>,
+    benchstat: Option<String>,
+    save_baseline: Option<String>,
+    fzf_args: Vec<String>,
+    prompt: Option<String>,
+    header: Option<String>,
+    /// Command and arguments to run go test under, like taskset or nice.
+    wrapper: Vec<String>,
+    only_subtests: bool,
+    /// Whether benchmarks are listed next to the tests, so that the run
+    /// pattern is also passed to -bench.
+    include_bench: bool,
+    go_args: Vec<String>,
+    /// Directory for go test to change to, resolved and absolute.
+    chdir: Option<PathBuf>,
+    debug_test: bool,
+    /// Run the whole parent test of every selected subtest.
+    expand_to_parent: bool,
+    explain: bool,
+    /// Print the packages of the selection instead of running it.
+    print_packages: bool,
+    /// Print go test commands for the selection instead of running it.
+    print_commands: bool,
+    batch_size: Option<usize>,
+    keep_going: bool,
+    /// How many packages to test at once, when running them separately.
+    parallel_packages: Option<usize>,
+    confirm: bool,
+    /// Shell command to pipe the go test output into.
+    pipe: Option<String>,
+    repl: bool,
 }
 
-fn skim_select(options: &[String]) -> Result<Vec<String>> {
-    let options_str = options.join("\n");
-    let item_reader = SkimItemReader::default();
-    let items = item_reader.of_bufread(Cursor::new(options_str));
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct TestInfo {
+    name: String,
+    file: String,
+    line: usize,
+    end_line: usize,
+    package: String,
+    /// Whether the file is in the external `foo_test` package.
+    external: bool,
+    kind: Kind,
+    /// Tags from a `// tags: a, b` line in the doc comment.
+    doc_tags: Vec<String>,
+    /// Whether the body starts with a `t.Skip` call, so it never runs.
+    skipped: bool,
+    /// Whether the doc comment has a `//testtool:focus` directive.
+    focused: bool,
+    /// Whether the file has a `// Code generated ... DO NOT EDIT.` header.
+    generated: bool,
+    /// Whether there is a doc comment, not counting directives.
+    documented: bool,
+    /// Whether the body starts with `t.Helper()`, so it is a helper.
+    helper: bool,
+    /// Bytes from the declaration to the closing brace, a rough measure of
+    /// how much the test does.
+    size: usize,
+    /// Paths under testdata named by string literals in the body, as written.
+    fixtures: Vec<String>,
+    /// Owners of the file according to CODEOWNERS, set after parsing.
+    owners: Vec<String>,
+    subtests: Vec<Subtest>,
+}
 
-    let skim_options = SkimOptionsBuilder::default()
-        .height("50%".to_string())
-        .color(Some("light".to_string()))
-        .multi(true)
-        .prompt("Select tests (TAB to multi-select): ".to_string())
-        .header(Some(
-            "Press TAB to select multiple tests, ENTER to confirm".to_string(),
-        ))
-        .build()
-        .map_err(|e| anyhow::anyhow!("Failed to build skim options: {}", e))?;
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct Subtest {
+    /// Name below the parent test, e.g. `a/b` for `b` nested in `a`.
+    name: String,
+    /// Lines of the `t.Run` call and the end of its closure.
+    line: usize,
+    end_line: usize,
+    /// The source of the table entry a table-driven subtest is named after:
+    /// the value of a map entry or a slice element, dedented and cut to
+    /// MAX_CASE_LINES lines.
+    case: Option<String>,
+}
 
-    let result = Skim::run_with(&skim_options, Some(items));
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+enum Kind {
+    Test,
+    Benchmark,
+    Fuzz,
+    Example,
+}
 
-    print!("\x1b[2J\x1b[H");
-    io::stdout().flush().unwrap();
+impl Kind {
+    fn as_str(self) -> &'static str {
+        match self {
+            Kind::Test => "test",
+            Kind::Benchmark => "benchmark",
+            Kind::Fuzz => "fuzz",
+            Kind::Example => "example",
+        }
+    }
 
-    if let Some(output) = result {
-        if output.is_abort {
-            return Ok(vec![]);
+    /// The type of the single parameter go test requires, empty for examples
+    /// which take none.
+    fn param_type(self) -> &'static str {
+        match self {
+            Kind::Test => "*testing.T",
+            Kind::Benchmark => "*testing.B",
+            Kind::Fuzz => "*testing.F",
+            Kind::Example => "",
         }
+    }
 
-        Ok(output
-            .selected_items
-            .iter()
-            .map(|item| item.output().to_string())
-            .collect())
-    } else {
-        Ok(vec![])
+    /// The kind of a name listed by `go test -list`, by its prefix.
+    fn of_name(name: &str) -> Kind {
+        if name.starts_with("Benchmark") {
+            Kind::Benchmark
+        } else if name.starts_with("Fuzz") {
+            Kind::Fuzz
+        } else if name.starts_with("Example") {
+            Kind::Example
+        } else {
+            Kind::Test
+        }
     }
 }
 
-fn build_run_pattern(selected_tests: &[String]) -> String {
-    if selected_tests.is_empty() {
-        return String::new();
+fn main() -> Result<()> {
+    let mut args = Args::parse();
+
+    // Subcommands take their own directories, which are searched like the
+    // top-level ones.
+    if let Some(Mode::Warm { directories } | Mode::Verify { directories }) = &mut args.mode {
+        args.directories.append(directories);
+    }
+    if matches!(args.mode, Some(Mode::Verify { .. }))
+        && (args.fzf
+            || args.watch_run
+            || args.diff.is_some()
+            || args.lens.is_some()
+            || args.from_clipboard)
+    {
+        anyhow::bail!(
+            "verify cannot be combined with --fzf, --watch-run, --diff, --lens or --from-clipboard"
+        );
     }
 
-    if selected_tests.len() == 1 {
-        return selected_tests[0].clone();
+    if matches!(args.mode, Some(Mode::Schema)) {
+        println!("{}", serde_json::to_string_pretty(&test_schema())?);
+        return Ok(());
     }
 
-    selected_tests.join("|")
-}
+    let manifest = match &args.manifest {
+        Some(path) => Some(Manifest::load(path)?),
+        None => None,
+    };
+    if let Some(manifest) = &manifest {
+        args.directories.extend(manifest.dirs().map(str::to_string));
+        args.tags.extend(manifest.tag_rules());
+    }
 
-fn execute_go_test(run_pattern: &str, tags: Option<String>, verbose: bool) -> Result<()> {
-    let mut cmd = Command::new("go");
-    cmd.args(["test", "-count=1"]);
+    let tags = TagRules::parse(&args.tags)?;
 
-    if verbose {
-        cmd.arg("-v");
+    let options = DiscoveryOptions {
+        warn: args.warn,
+        build: BuildContext::new(
+            args.goos.clone(),
+            args.goarch.clone(),
+            args.cgo_override(),
+            tags.clone(),
+        ),
+        exclude: args
+            .exclude_test
+            .iter()
+            .map(|pattern| {
+                Regex::new(&format!("^(?:{})$", pattern))
+                    .with_context(|| format!("invalid --exclude-test regex {:?}", pattern))
+            })
+            .collect::<Result<_>>()?,
+        dir_exclude: manifest
+            .as_ref()
+            .map(Manifest::dir_excludes)
+            .unwrap_or_default(),
+        scan_subtests: !args.no_subtests_scan,
+        profile: args.profile_discovery,
+        progress: args.progress
+            && io::stdout().is_terminal()
+            && io::stderr().is_terminal()
+            && !(args.ndjson
+                || args.format.is_some()
+                || args.packages
+                || args.as_commands
+                || args.gen_testmain
+                || args.tsv
+                || args.metrics
+                || args.list_files
+                || args.untested
+                || args.json_run),
+        prefixes: args.prefixes.clone(),
+        kinds: if args.bench {
+            vec![Kind::Benchmark]
+        } else {
+            [
+                (true, Kind::Test),
+                (args.include_bench, Kind::Benchmark),
+                (args.include_fuzz || args.fuzz_corpus.is_some(), Kind::Fuzz),
+                (args.include_examples, Kind::Example),
+            ]
+            .into_iter()
+            .filter_map(|(include, kind)| include.then_some(kind))
+            .collect()
+        },
+        subtest_patterns: SubtestPatterns::new()?,
+        recurse: !args.no_recurse,
+        suffix: if args.suffix.ends_with("_test.go") {
+            args.suffix.clone()
+        } else {
+            anyhow::bail!("--suffix must end in _test.go, go test reads no other files")
+        },
+        any_platform: false,
+    };
+
+    let run_options = RunOptions {
+        tags,
+        verbose: args.verbose,
+        // Packages in the module cache are outside the current module, so
+        // ./... doesn't cover them; they are always passed by import path.
+        tidy: args.tidy
+            || args
+                .directories()
+                .iter()
+                .any(|dir| gomod::in_module_cache(Path::new(glob::base(dir)))),
+        shuffle_seed: args.shuffle_seed.or_else(|| args.shuffle.then(time_seed)),
+        package_seed: args
+            .shuffle_packages
+            .then(|| args.shuffle_seed.unwrap_or_else(time_seed)),
+        topo_order: args.topo_order,
+        validate: args.validate,
+        sort: args.sort,
+        query: args.query.clone(),
+        json_run: args.json_run,
+        summary_only: args.summary_only,
+        env: args
+            .env
+            .iter()
+            .map(|value| parse_env(value))
+            .chain(
+                args.memory_limit
+                    .iter()
+                    .map(|limit| Ok(("GOMEMLIMIT".to_string(), limit.clone()))),
+            )
+            .chain(args.cgo_override().map(|cgo| {
+                Ok((
+                    "CGO_ENABLED".to_string(),
+                    if cgo { "1" } else { "0" }.to_string(),
+                ))
+            }))
+            .collect::<Result<_>>()?,
+        anchor: !args.no_anchor,
+        bench_count: args.bench.then_some(args.bench_count),
+        stress: match args.stress {
+            Some(0) => anyhow::bail!("--stress must be at least 1"),
+            count => count,
+        },
+        benchstat: args.benchstat.clone(),
+        save_baseline: args.save_baseline.clone(),
+        fzf_args: match &args.fzf_args {
+            Some(line) => skim_args::split(line)?,
+            None => Vec::new(),
+        },
+        prompt: args.prompt.clone(),
+        header: args.header.clone(),
+        wrapper: resource_wrapper(args.cpus.as_deref(), args.nice),
+        only_subtests: args.only_subtests,
+        include_bench: args.include_bench,
+        go_args: check_go_args(&args.go_args)?,
+        debug_test: args.debug_test,
+        expand_to_parent: args.expand_to_parent,
+        explain: args.explain,
+        print_packages: args.packages,
+        print_commands: args.as_commands,
+        batch_size: match args.batch_size {
+            Some(0) => anyhow::bail!("--batch-size must be at least 1"),
+            size => size,
+        },
+        confirm: args.confirm,
+        keep_going: args.keep_going,
+        parallel_packages: match args.parallel_packages {
+            Some(Some(0)) => anyhow::bail!("--parallel-packages must be at least 1"),
+            Some(jobs) => Some(jobs.unwrap_or_else(default_jobs)),
+            None => None,
+        },
+        pipe: args.pipe.clone(),
+        repl: args.repl,
+        chdir: match &args.chdir {
+            Some(dir) => {
+                Some(std::fs::canonicalize(dir).with_context(|| format!("cannot use -C {}", dir))?)
+            }
+            None => None,
+        },
+    };
+
+    if let Some(dirs) = &args.diff {
+        return diff_patterns(&dirs[0], &dirs[1], &args, &options);
     }
 
-    if let Some(tags_value) = tags {
-        cmd.arg(format!("-tags={}", tags_value));
+    if args.from_clipboard {
+        let code = run_from_clipboard(&run_options)?;
+        if code != 0 {
+            std::process::exit(code);
+        }
+        return Ok(());
     }
 
-    if !run_pattern.is_empty() {
-        cmd.arg("-run").arg(run_pattern);
+    if args.watch_run {
+        return run_watch(&args, &options, &run_options);
     }
 
-    cmd.arg("./...");
+    if args.list_platforms {
+        let options = DiscoveryOptions {
+            any_platform: true,
+            ..options
+        };
+        return list_platforms(&args.directories(), &args, &options);
+    }
 
-    println!(
-        "Running: go {}",
-        cmd.get_args()
-            .map(|arg| arg.to_string_lossy())
-            .collect::<Vec<_>>()
-            .join(" ")
-    );
+    if let Some(file) = &args.lens {
+        return print_lens(file, &args, &options, &run_options);
+    }
 
-    let status = cmd.status()?;
+    if matches!(args.mode, Some(Mode::Verify { .. })) {
+        return verify(&args.directories(), &options);
+    }
 
-    if !status.success() {
-        std::process::exit(status.code().unwrap_or(1));
+    let (cache_key, mut cache) = load_cache(&args.directories(), &options);
+    let mut tests = discover(&args.directories(), &args, &options, &mut cache)?;
+    save_cache(cache_key.as_deref(), &cache);
+
+    if matches!(args.mode, Some(Mode::Warm { .. })) {
+        println!("cached {} file(s)", cache.files.len());
+        return Ok(());
+    }
+
+    if tests.is_empty() {
+        explain_no_tests(&args.directories(), args.strict)?;
+    }
+
+    if args.go_order {
+        sort_go_order(&mut tests);
+    }
+
+    if args.rerun_failed {
+        rerun_failed(&tests, &run_options)?;
+    } else if let Some(count) = args.recent {
+        run_recent(&tests, &cache, count, &run_options)?;
+    } else if args.run_changed_subtests {
+        run_changed(&tests, &args.directories(), &args.base, &run_options)?;
+    } else if args.scaffold {
+        scaffold_subtest(&tests, &run_options)?;
+    } else if args.fzf {
+        run_with_skim(tests, &run_options)?;
+    } else if args.ndjson {
+        print_ndjson(&tests)?;
+    } else if args.packages {
+        print_packages(tests.iter().map(|test| test.package.clone()));
+    } else if args.gen_testmain {
+        print_run_file(&tests, &run_options);
+    } else if args.as_commands {
+        print_commands(
+            &tests,
+            &candidate_patterns(&tests, &run_options),
+            &run_options,
+        );
+    } else if let Some(format) = args.format {
+        print_document(&tests, format)?;
+    } else if args.list_files {
+        print_files(&tests);
+    } else if args.untested {
+        print_untested(&args.directories(), &tests, &options)?;
+    } else if args.metrics {
+        print_metrics(&tests);
+    } else if args.tsv {
+        print_tsv(&tests);
+    } else {
+        print_tests(&tests, &args);
+    }
+
+    Ok(())
+}
+
+/// Identifies what parsing depends on besides the files themselves: where
+/// the walk starts, the discovery options and the parser's own version.
+fn cache_key(dirs: &[&str], options: &DiscoveryOptions) -> String {
+    let cwd = std::env::current_dir().unwrap_or_default();
+
+    format!(
+        "{}\n{}\n{}\n{:?}\n{:?}\n{:?}\n{}\n{}\n{}",
+        cwd.display(),
+        dirs.join(" "),
+        LONG_VERSION,
+        options.build,
+        options.prefixes,
+        options.kinds,
+        options.scan_subtests,
+        options.recurse,
+        options.suffix
+    )
+}
+
+/// Loads the saved parse cache for searching `dirs`, returning it with the
+/// key to save it under. With --warn, which needs every file parsed to
+/// report its warnings, the cache starts empty. Trees in the module cache
+/// never change and can hold any number of modules, so they are not worth
+/// keeping parsed: they get an empty cache and no key.
+fn load_cache(dirs: &[&str], options: &DiscoveryOptions) -> (Option<String>, ParseCache) {
+    if dirs
+        .iter()
+        .any(|dir| gomod::in_module_cache(Path::new(glob::base(dir))))
+    {
+        return (None, ParseCache::default());
+    }
+
+    let key = cache_key(dirs, options);
+    let cache = if options.warn {
+        ParseCache::default()
+    } else {
+        ParseCache::load(&key)
+    };
+    (Some(key), cache)
+}
+
+/// Saves a cache from [`load_cache`] under its key, if it has one.
+fn save_cache(key: Option<&str>, cache: &ParseCache) {
+    if let Some(key) = key
+        && let Err(err) = cache.save(key)
+    {
+        eprintln!("warning: could not save the parse cache: {}", err);
+    }
+}
+
+/// Tells apart, for each directory, one with Go code but no tests from one
+/// without any Go files, which is usually a mistyped path. With `strict`,
+/// the latter fail once all directories are reported.
+fn explain_no_tests(dirs: &[&str], strict: bool) -> Result<()> {
+    let mut without_go = Vec::new();
+    let mut explained = HashSet::new();
+
+    for &dir in dirs {
+        if !explained.insert(dir) {
+            continue;
+        }
+
+        let has_go_files = glob::distinct_roots(&[dir])?
+            .iter()
+            .flat_map(WalkDir::new)
+            .filter_map(|entry| entry.ok())
+            .any(|entry| entry.path().extension().is_some_and(|ext| ext == "go"));
+
+        if Path::new(dir).is_file() {
+            eprintln!("note: {} contains no tests", dir);
+        } else if has_go_files {
+            eprintln!("note: no tests found in {}", dir);
+        } else if strict {
+            without_go.push(dir);
+        } else {
+            eprintln!("note: {} contains no Go files, is the path right?", dir);
+        }
+    }
+
+    if !without_go.is_empty() {
+        anyhow::bail!("{} contains no Go files", without_go.join(", "));
     }
 
     Ok(())
 }
+
+fn parse_env(value: &str) -> Result<(String, String)> {
+    match value.split_once('=') {
+        Some((key, value)) if !key.is_empty() && !key.contains(char::is_whitespace) => {
+            Ok((key.to_string(), value.to_string()))
+        }
+        _ => anyhow::bail!("invalid --env value {:?}: expected KEY=VALUE", value),
+    }
+}
+
+/// Rejects go test flags after `--` that would replace the pattern built from
+/// the selection.
+fn check_go_args(go_args: &[String]) -> Result<Vec<String>> {
+    let flags = go_args.iter().take_while(|arg| *arg != "-args");
+
+    for arg in flags {
+        let name = arg.trim_start_matches('-').split('=').next().unwrap_or("");
+        if arg.starts_with('-') && matches!(name, "run" | "test.run" | "bench" | "test.bench") {
+            anyhow::bail!(
+                "{} after -- would replace the pattern of the selected tests",
+                arg
+            );
+        }
+    }
+
+    Ok(go_args.to_vec())
+}
+
+/// Returns the taskset and nice invocation to run go test under. Both are
+/// Linux only and ignored with a warning elsewhere.
+fn resource_wrapper(cpus: Option<&str>, nice: Option<i32>) -> Vec<String> {
+    if cpus.is_none() && nice.is_none() {
+        return Vec::new();
+    }
+
+    if !cfg!(target_os = "linux") {
+        eprintln!("warning: --cpus and --nice are only supported on Linux, ignoring them");
+        return Vec::new();
+    }
+
+    let mut wrapper = Vec::new();
+    if let Some(cpus) = cpus {
+        wrapper.extend(["taskset".to_string(), "-c".to_string(), cpus.to_string()]);
+    }
+    if let Some(nice) = nice {
+        wrapper.extend(["nice".to_string(), "-n".to_string(), nice.to_string()]);
+    }
+
+    wrapper
+}
+
+/// Wraps `cmd` in the --cpus/--nice wrapper, if any.
+fn wrap_command(cmd: Command, wrapper: &[String]) -> Command {
+    let Some((program, args)) = wrapper.split_first() else {
+        return cmd;
+    };
+
+    let mut wrapped = Command::new(program);
+    wrapped
+        .args(args)
+        .arg(cmd.get_program())
+        .args(cmd.get_args());
+    for (key, value) in cmd.get_envs() {
+        if let Some(value) = value {
+            wrapped.env(key, value);
+        }
+    }
+
+    wrapped
+}
+
+/// Returns GOMAXPROCS if set, like go test's own default parallelism, or the
+/// number of CPUs.
+fn default_jobs() -> usize {
+    std::env::var("GOMAXPROCS")
+        .ok()
+        .and_then(|value| value.parse().ok())
+        .filter(|&jobs| jobs > 0)
+        .or_else(|| thread::available_parallelism().ok().map(usize::from))
+        .unwrap_or(1)
+}
+
+fn time_seed() -> i64 {
+    SystemTime::now()
+        .duration_since(SystemTime::UNIX_EPOCH)
+        .map_or(0, |elapsed| elapsed.as_nanos() as i64)
+}
+
+fn discover(
+    dirs: &[&str],
+    args: &Args,
+    options: &DiscoveryOptions,
+    cache: &mut ParseCache,
+) -> Result<Vec<TestInfo>> {
+    let mut tests = find_tests(dirs, options, cache)?;
+
+    if args.use_golist {
+        for dir in dirs {
+            tests = merge_golist(
+                tests,
+                glob::base(dir),
+                options.build.tags.default_tags(),
+                &options.kinds,
+                options.recurse,
+            );
+        }
+    }
+
+    if args.affected {
+        let mut affected_dirs = HashSet::new();
+        for dir in dirs {
+            affected_dirs.extend(affected::affected_dirs(
+                glob::base(dir),
+                &args.base,
+                options.build.tags.default_tags(),
+            )?);
+        }
+        tests.retain(|test| {
+            Path::new(&test.file)
+                .parent()
+                .is_some_and(|dir| affected_dirs.contains(&affected::canonical(dir)))
+        });
+    }
+
+    if args.dirty {
+        let dirty: Result<Vec<_>> = dirs
+            .iter()
+            .map(|dir| affected::dirty_files(glob::base(dir)))
+            .collect();
+        match dirty {
+            Ok(dirty) => tests.retain(|test| {
+                let file = affected::canonical(Path::new(&test.file));
+                dirty.iter().any(|files| files.contains(&file))
+            }),
+            Err(err) => eprintln!(
+                "warning: {}, listing all tests instead of those with uncommitted changes",
+                err
+            ),
+        }
+    }
+
+    if !args.no_focus {
+        focus(&mut tests);
+    }
+
+    assign_owners(&mut tests);
+    if !args.owner.is_empty() {
+        tests.retain(|test| test.owners.iter().any(|owner| args.owner.contains(owner)));
+    }
+
+    if args.hide_skipped || args.skipped_only {
+        tests.retain(|test| test.skipped == args.skipped_only);
+    }
+
+    if args.skip_generated || args.generated_only {
+        tests.retain(|test| test.generated == args.generated_only);
+    }
+
+    if args.exclude_helpers {
+        tests.retain(|test| !test.helper);
+    }
+
+    if args.undocumented && args.warn {
+        // Tests known only from go test -list have no source to document.
+        for test in tests
+            .iter()
+            .filter(|test| !test.documented && test.line > 0)
+        {
+            eprintln!(
+                "{}:{}: warning: {} has no doc comment",
+                test.file, test.line, test.name
+            );
+        }
+    } else if args.undocumented || args.only_with_doc {
+        tests.retain(|test| test.documented == args.only_with_doc);
+    }
+
+    if args.external_only || args.internal_only {
+        tests.retain(|test| test.external == args.external_only);
+    }
+
+    if !args.has_tag.is_empty() {
+        tests.retain(|test| args.has_tag.iter().all(|tag| test.doc_tags.contains(tag)));
+    }
+
+    if !options.exclude.is_empty() {
+        exclude_tests(&mut tests, &options.exclude);
+    }
+    if !options.dir_exclude.is_empty() {
+        exclude_under(&mut tests, &options.dir_exclude);
+    }
+
+    // After exclusion, so that excluded subtests do not count.
+    if let Some(min) = args.min_subtests {
+        tests.retain(|test| test.subtests.len() >= min);
+    }
+
+    if let Some(filter @ (CorpusFilter::With | CorpusFilter::Without)) = args.fuzz_corpus {
+        tests.retain(|test| {
+            test.kind == Kind::Fuzz
+                && seed_corpus(test).is_some_and(|files| files > 0)
+                    == (filter == CorpusFilter::With)
+        });
+    }
+
+    Ok(tests)
+}
+
+/// Keeps only the tests with a `//testtool:focus` directive if there are
+/// any, warning on stderr so the directive is not forgotten and committed.
+fn focus(tests: &mut Vec<TestInfo>) {
+    let focused: Vec<&TestInfo> = tests.iter().filter(|test| test.focused).collect();
+    if focused.is_empty() {
+        return;
+    }
+
+    eprintln!(
+        "warning: FOCUS ACTIVE: only the {} test(s) marked //testtool:focus are considered (pass --no-focus to ignore the directive, and remove it before committing):",
+        focused.len()
+    );
+    for test in focused {
+        eprintln!("    {} ({}:{})", test.name, test.file, test.line);
+    }
+
+    tests.retain(|test| test.focused);
+}
+
+/// Sorts tests the way go test runs them. Packages come in the order of
+/// `go test ./...`, sorted by import path. In a package, the generated test
+/// main runs the tests, then the fuzz targets' seed corpora, the examples and
+/// the benchmarks, each taken from the package's test files in name order
+/// and then from the external `_test` package's.
+fn sort_go_order(tests: &mut [TestInfo]) {
+    let mut import_paths = HashMap::new();
+    for test in tests.iter() {
+        import_paths.entry(test.package.clone()).or_insert_with(|| {
+            gomod::import_path(Path::new(&test.package)).unwrap_or(test.package.clone())
+        });
+    }
+
+    let kind_order = |kind: Kind| match kind {
+        Kind::Test => 0,
+        Kind::Fuzz => 1,
+        Kind::Example => 2,
+        Kind::Benchmark => 3,
+    };
+    tests.sort_by(|a, b| {
+        (
+            &import_paths[&a.package],
+            kind_order(a.kind),
+            a.external,
+            Path::new(&a.file).file_name(),
+            a.line,
+        )
+            .cmp(&(
+                &import_paths[&b.package],
+                kind_order(b.kind),
+                b.external,
+                Path::new(&b.file).file_name(),
+                b.line,
+            ))
+    });
+}
+
+/// Sets the owners of each parsed test from the CODEOWNERS file of the git
+/// repository its file is in, if there is one.
+fn assign_owners(tests: &mut [TestInfo]) {
+    let mut roots: HashMap<PathBuf, Option<PathBuf>> = HashMap::new();
+    let mut files: HashMap<PathBuf, Option<CodeOwners>> = HashMap::new();
+
+    for test in tests.iter_mut().filter(|test| test.line > 0) {
+        let path = affected::canonical(Path::new(&test.file));
+        let Some(dir) = path.parent() else {
+            continue;
+        };
+        let root = roots
+            .entry(dir.to_path_buf())
+            .or_insert_with(|| codeowners::repo_root(dir));
+        let Some(root) = root else {
+            continue;
+        };
+
+        if let Some(owners) = files
+            .entry(root.clone())
+            .or_insert_with(|| CodeOwners::load(root))
+        {
+            test.owners = owners.owners(&path);
+        }
+    }
+}
+
+/// Counts the files in a fuzz target's seed corpus directory,
+/// testdata/fuzz/NAME next to its file, or `None` if there is none.
+fn seed_corpus(test: &TestInfo) -> Option<usize> {
+    let dir = Path::new(&test.file)
+        .parent()?
+        .join("testdata")
+        .join("fuzz")
+        .join(&test.name);
+    let entries = std::fs::read_dir(dir).ok()?;
+
+    Some(
+        entries
+            .filter_map(|entry| entry.ok())
+            .filter(|entry| entry.file_type().is_ok_and(|kind| kind.is_file()))
+            .count(),
+    )
+}
+
+/// Leaves out the tests and subtests matching a pattern of a directory
+/// containing their file.
+fn exclude_under(tests: &mut Vec<TestInfo>, dir_exclude: &[(PathBuf, Regex)]) {
+    let applying = |test: &TestInfo| -> Vec<&Regex> {
+        let file = affected::canonical(Path::new(&test.file));
+        dir_exclude
+            .iter()
+            .filter(|(dir, _)| file.starts_with(dir))
+            .map(|(_, regex)| regex)
+            .collect()
+    };
+
+    tests.retain(|test| {
+        !applying(test)
+            .iter()
+            .any(|regex| regex.is_match(&test.name))
+    });
+    for test in tests.iter_mut() {
+        let exclude = applying(test);
+        let name = &test.name;
+        test.subtests.retain(|subtest| {
+            !exclude
+                .iter()
+                .any(|regex| regex.is_match(&format!("{}/{}", name, subtest.name)))
+        });
+    }
+}
+
+/// Drops tests whose name, and subtests whose full pattern, match any of the
+/// exclude regexes.
+fn exclude_tests(tests: &mut Vec<TestInfo>, exclude: &[Regex]) {
+    let excluded = |pattern: &str| exclude.iter().any(|regex| regex.is_match(pattern));
+
+    tests.retain(|test| !excluded(&test.name));
+    for test in tests.iter_mut() {
+        let name = test.name.clone();
+        test.subtests
+            .retain(|subtest| !excluded(&format!("{}/{}", name, subtest.name)));
+    }
+}
+
+/// Makes `go test -list` authoritative for which top-level tests exist, while
+/// keeping the subtests and locations found by parsing. Listed functions of
+/// kinds not in `kinds`, and without `recurse` those in packages below `dir`,
+/// are left out.
+fn merge_golist(
+    tests: Vec<TestInfo>,
+    dir: &str,
+    tags: Option<&str>,
+    kinds: &[Kind],
+    recurse: bool,
+) -> Vec<TestInfo> {
+    let listed = match golist::list_tests(dir, tags) {
+        Ok(listed) => listed,
+        Err(err) => {
+            eprintln!(
+                "warning: go test -list failed ({}), using parsed tests only",
+                err
+            );
+            return tests;
+        }
+    };
+
+    let package_dirs: Vec<PathBuf> = tests
+        .iter()
+        .map(|test| affected::canonical(Path::new(&test.package)))
+        .collect();
+
+    let mut known = HashSet::new();
+    let mut merged = Vec::new();
+
+    for (test, pkg_dir) in tests.into_iter().zip(package_dirs) {
+        // Packages go test could not list (e.g. build failures) keep their
+        // parsed tests, as do --prefixes functions go test does not know.
+        if (test.kind == Kind::Test && !test.name.starts_with("Test"))
+            || listed
+                .get(&pkg_dir)
+                .is_none_or(|names| names.contains(&test.name))
+        {
+            known.insert((pkg_dir, test.name.clone()));
+            merged.push(test);
+        }
+    }
+
+    let root = affected::canonical(Path::new(dir));
+    for (pkg_dir, names) in &listed {
+        for name in names {
+            let kind = Kind::of_name(name);
+            if !kinds.contains(&kind)
+                || known.contains(&(pkg_dir.clone(), name.clone()))
+                || (!recurse && pkg_dir != &root)
+            {
+                continue;
+            }
+
+            let package = match pkg_dir.strip_prefix(&root) {
+                Ok(relative) if relative.as_os_str().is_empty() => {
+                    format_package_dir(Path::new(dir))
+                }
+                Ok(relative) => format_package_dir(&Path::new(dir).join(relative)),
+                Err(_) => format_package_dir(pkg_dir),
+            };
+
+            merged.push(TestInfo {
+                name: name.clone(),
+                file: package.clone(),
+                line: 0,
+                end_line: 0,
+                package,
+                external: false,
+                kind,
+                doc_tags: Vec::new(),
+                skipped: false,
+                focused: false,
+                generated: false,
+                documented: false,
+                helper: false,
+                size: 0,
+                fixtures: Vec::new(),
+                owners: Vec::new(),
+                subtests: Vec::new(),
+            });
+        }
+    }
+
+    merged
+}
+
+fn find_tests(
+    dirs: &[&str],
+    options: &DiscoveryOptions,
+    cache: &mut ParseCache,
+) -> Result<Vec<TestInfo>> {
+    let mut tests = Vec::new();
+    let mut files = HashMap::new();
+    let mut timings = Vec::new();
+    let mut progress = options.progress.then(Progress::new);
+
+    let roots = glob::distinct_roots(dirs)?;
+    for (root, entry) in roots.iter().flat_map(|root| {
+        WalkDir::new(root)
+            .max_depth(if options.recurse { usize::MAX } else { 1 })
+            .sort_by_file_name()
+            .into_iter()
+            .map(move |entry| (root, entry))
+    }) {
+        let root = root.to_string_lossy();
+        let entry = entry.map_err(|err| DiscoveryError::walk(&root, err))?;
+        let path = entry.path();
+
+        // A file given as the argument is parsed whatever its name, so that
+        // editors can pass the current buffer.
+        let explicit = entry.depth() == 0 && entry.file_type().is_file();
+
+        if path.extension().is_some_and(|ext| ext == "go")
+            && (explicit
+                || path.file_name().is_some_and(|name| {
+                    let name = name.to_string_lossy();
+                    name.ends_with(&options.suffix)
+                        && (options.any_platform || options.build.matches_file_name(path))
+                }))
+        {
+            let modified = entry
+                .metadata()
+                .map_err(|err| DiscoveryError::walk(&root, err))?
+                .modified()
+                .map_err(|err| DiscoveryError::read(path, err))?;
+
+            if let Some(progress) = &mut progress {
+                progress.update(tests.len());
+            }
+
+            if let Some(cached) = cache.files.remove(path)
+                && cached.modified == modified
+            {
+                tests.extend(cached.tests.iter().cloned());
+                files.insert(path.to_path_buf(), cached);
+                continue;
+            }
+
+            cache.changed = true;
+            let started = options.profile.map(|_| Instant::now());
+            let content =
+                std::fs::read_to_string(path).map_err(|err| DiscoveryError::read(path, err))?;
+
+            let file_tests =
+                if options.any_platform || options.build.matches_constraints(path, &content) {
+                    if options.warn {
+                        for warning in lint_test_file(path, &content)? {
+                            eprintln!("{}", warning);
+                        }
+                    }
+
+                    parse_test_file(path, &content, options)?
+                } else {
+                    Vec::new()
+                };
+
+            if let Some(started) = started {
+                timings.push((path.to_path_buf(), started.elapsed()));
+            }
+
+            tests.extend(file_tests.iter().cloned());
+            files.insert(
+                path.to_path_buf(),
+                CachedFile {
+                    modified,
+                    tests: file_tests,
+                },
+            );
+        }
+    }
+
+    // Entries left over are files that no longer exist.
+    cache.changed |= !cache.files.is_empty();
+    cache.files = files;
+
+    if let Some(progress) = progress {
+        progress.finish();
+    }
+
+    if let Some(top) = options.profile {
+        print_profile(timings, top);
+    }
+
+    // Directory listing order depends on the filesystem, so sort to keep the
+    // output stable. Subtests stay in source order within each test.
+    tests.sort_by(|a, b| a.file.cmp(&b.file).then(a.line.cmp(&b.line)));
+
+    Ok(tests)
+}
+
+/// A status line on stderr, redrawn at most every PROGRESS_INTERVAL.
+struct Progress {
+    files: usize,
+    last: Instant,
+    shown: bool,
+}
+
+impl Progress {
+    fn new() -> Self {
+        Progress {
+            files: 0,
+            last: Instant::now(),
+            shown: false,
+        }
+    }
+
+    /// Counts a scanned file, with `tests` found before it.
+    fn update(&mut self, tests: usize) {
+        self.files += 1;
+        if self.last.elapsed() >= PROGRESS_INTERVAL {
+            eprint!(
+                "\r\x1b[Kscanned {} file(s), found {} test(s)",
+                self.files, tests
+            );
+            self.last = Instant::now();
+            self.shown = true;
+        }
+    }
+
+    /// Clears the status line, if it was ever drawn.
+    fn finish(self) {
+        if self.shown {
+            eprint!("\r\x1b[K");
+        }
+    }
+}
+
+/// Prints the total parse time and the `top` slowest files to stderr.
+/// Files reused from the cache are not parsed and so not listed.
+fn print_profile(mut timings: Vec<(PathBuf, Duration)>, top: usize) {
+    let total: Duration = timings.iter().map(|(_, elapsed)| *elapsed).sum();
+    eprintln!(
+        "parsed {} file(s) in {:.2?}, slowest:",
+        timings.len(),
+        total
+    );
+
+    timings.sort_by(|(_, a), (_, b)| b.cmp(a));
+    for (path, elapsed) in timings.iter().take(top) {
+        eprintln!("{:>10.2?}  {}", elapsed, path.display());
+    }
+}
+
+fn parse_test_file(
+    path: &Path,
+    content: &str,
+    options: &DiscoveryOptions,
+) -> Result<Vec<TestInfo>> {
+    let mut tests = Vec::new();
+
+    let mut prefixes: Vec<(&str, Kind)> = Vec::new();
+    for kind in &options.kinds {
+        match kind {
+            Kind::Test => prefixes.extend(
+                options
+                    .prefixes
+                    .iter()
+                    .filter(|prefix| !prefix.is_empty())
+                    .map(|prefix| (prefix.as_str(), Kind::Test)),
+            ),
+            Kind::Benchmark => prefixes.push(("Benchmark", Kind::Benchmark)),
+            Kind::Fuzz => prefixes.push(("Fuzz", Kind::Fuzz)),
+            Kind::Example => prefixes.push(("Example", Kind::Example)),
+        }
+    }
+
+    // Longest first, so that a prefix which is the start of another one does
+    // not hide it.
+    prefixes.sort_by_key(|(prefix, _)| std::cmp::Reverse(prefix.len()));
+    let alternatives: Vec<String> = prefixes.iter().map(|(p, _)| regex::escape(p)).collect();
+
+    let test_func_regex = Regex::new(&format!(
+        r"^func\s+(({})\w*)\s*(\[[^\]]*\])?\s*\(([^)]*)\)",
+        alternatives.join("|")
+    ))?;
+
+    let lines: Vec<&str> = content.lines().collect();
+    let external = lines
+        .iter()
+        .find_map(|line| line.strip_prefix("package "))
+        .is_some_and(|name| name.trim().ends_with("_test"));
+    let generated = is_generated(&lines);
+    let scanner = if options.scan_subtests {
+        Some(SubtestScanner::new(&lines, &options.subtest_patterns))
+    } else {
+        None
+    };
+
+    for (line_num, line) in lines.iter().enumerate() {
+        if let Some(caps) = test_func_regex.captures(line)
+            && let Some(&(_, kind)) = prefixes.iter().find(|(prefix, _)| *prefix == &caps[2])
+            && is_test_function(&caps[1], &caps[2], caps.get(3).is_some(), &caps[4], kind)
+        {
+            let test_name = caps.get(1).unwrap().as_str().to_string();
+            let end = function_end(&lines, line_num);
+            let mut subtests = Vec::new();
+
+            if let Some(scanner) = &scanner {
+                let mut visiting = vec![caps.get(1).unwrap().as_str()];
+                scanner.scan(
+                    line_num,
+                    end,
+                    "",
+                    &Bindings::new(),
+                    &mut visiting,
+                    &mut subtests,
+                );
+            }
+
+            tests.push(TestInfo {
+                name: test_name,
+                file: path.to_string_lossy().to_string(),
+                line: line_num + 1,
+                end_line: end.min(lines.len().saturating_sub(1)) + 1,
+                package: package_dir(path),
+                external,
+                kind,
+                doc_tags: doc_tags(&lines, line_num),
+                skipped: skips_first(&lines, line_num, &caps[4]),
+                focused: doc_comment(&lines, line_num).any(|line| line == "//testtool:focus"),
+                generated,
+                documented: doc_comment(&lines, line_num).any(|line| !is_directive(line)),
+                helper: is_helper(&lines, line_num, &caps[4]),
+                size: lines[line_num..=end.min(lines.len() - 1)]
+                    .iter()
+                    .map(|line| line.len() + 1)
+                    .sum(),
+                fixtures: fixtures(&lines[line_num..=end.min(lines.len() - 1)]),
+                owners: Vec::new(),
+                subtests,
+            });
+        }
+    }
+
+    Ok(tests)
+}
+
+/// Returns the testdata paths named by string literals in `body`, in order
+/// and without repeats. A literal that is just the testdata directory, as in
+/// `filepath.Join("testdata", "in.json")`, is joined with the literals
+/// passed after it. Paths built from variables are not followed.
+fn fixtures(body: &[&str]) -> Vec<String> {
+    static LITERAL: OnceLock<Regex> = OnceLock::new();
+    let literal = LITERAL.get_or_init(|| Regex::new(r#""((?:[^"\\]|\\.)*)"|`([^`]*)`"#).unwrap());
+
+    let mut fixtures = Vec::new();
+    for line in body {
+        if line.trim_start().starts_with("//") || !line.contains("testdata") {
+            continue;
+        }
+
+        let literals: Vec<_> = literal.captures_iter(line).collect();
+        for (index, caps) in literals.iter().enumerate() {
+            let value = caps.get(1).or(caps.get(2)).unwrap().as_str();
+            if !value.contains("testdata") {
+                continue;
+            }
+
+            let mut path = value.to_string();
+            if value.trim_end_matches('/').ends_with("testdata") {
+                let mut end = caps.get(0).unwrap().end();
+                for next in &literals[index + 1..] {
+                    let whole = next.get(0).unwrap();
+                    if line[end..whole.start()].trim() != "," {
+                        break;
+                    }
+                    let part = next.get(1).or(next.get(2)).unwrap().as_str();
+                    path = format!("{}/{}", path.trim_end_matches('/'), part);
+                    end = whole.end();
+                }
+            }
+
+            if !fixtures.contains(&path) {
+                fixtures.push(path);
+            }
+        }
+    }
+    fixtures
+}
+
+/// Returns the tags declared by a `// tags: a, b` line in the doc comment
+/// directly above the function declared at `line_num`.
+fn doc_tags(lines: &[&str], line_num: usize) -> Vec<String> {
+    doc_comment(lines, line_num)
+        .filter_map(|line| line.strip_prefix("//"))
+        .filter_map(|comment| comment.trim().strip_prefix("tags:"))
+        .flat_map(|tags| tags.split(',').map(|tag| tag.trim().to_string()))
+        .filter(|tag| !tag.is_empty())
+        .collect()
+}
+
+/// Reports whether the file has the `// Code generated ... DO NOT EDIT.`
+/// line that marks generated Go code before its package clause.
+fn is_generated(lines: &[&str]) -> bool {
+    lines
+        .iter()
+        .take_while(|line| !line.starts_with("package "))
+        .any(|line| line.starts_with("// Code generated ") && line.ends_with(" DO NOT EDIT."))
+}
+
+/// Returns the trimmed lines of the doc comment directly above the function
+/// declared at `line_num`, last line first.
+fn doc_comment<'a>(lines: &[&'a str], line_num: usize) -> impl Iterator<Item = &'a str> {
+    lines[..line_num]
+        .iter()
+        .rev()
+        .map(|line| line.trim())
+        .take_while(|line| line.starts_with("//"))
+}
+
+/// Reports whether a comment line is a directive like `//go:noinline` or
+/// `//testtool:focus`, which go doc leaves out of the documentation.
+fn is_directive(line: &str) -> bool {
+    line.strip_prefix("//").is_some_and(|rest| {
+        rest.split_once(':').is_some_and(|(name, _)| {
+            !name.is_empty()
+                && name
+                    .chars()
+                    .all(|c| c.is_ascii_lowercase() || c.is_ascii_digit())
+        })
+    })
+}
+
+/// Reports whether the function declared at `line_num` with parameters
+/// `params` starts by calling `t.Helper()`, which marks a helper misnamed as
+/// a test.
+fn is_helper(lines: &[&str], line_num: usize, params: &str) -> bool {
+    params.split_whitespace().next().is_some_and(|param| {
+        first_statement(lines, line_num)
+            .and_then(|statement| statement.strip_prefix(param))
+            .is_some_and(|call| call.starts_with(".Helper()"))
+    })
+}
+
+/// Returns the first line of the body of the function declared at
+/// `line_num` that is not blank or a comment, trimmed, or what follows the
+/// brace when the body starts on the declaration's line.
+fn first_statement<'a>(lines: &[&'a str], line_num: usize) -> Option<&'a str> {
+    let after_brace = lines[line_num].split_once('{').map_or("", |(_, rest)| rest);
+    std::iter::once(after_brace)
+        .chain(lines[line_num + 1..].iter().copied())
+        .map(str::trim)
+        .find(|line| !line.is_empty() && !line.starts_with("//"))
+}
+
+/// Reports whether the first statement of the function declared at
+/// `line_num` with parameters `params` skips the test: `t.Skip(...)`,
+/// `t.Skipf(...)` or `t.SkipNow()` on the declaration's line after the brace
+/// or as the first line of the body that is not blank or a comment. Skips
+/// behind a condition are not the first statement and not reported.
+fn skips_first(lines: &[&str], line_num: usize, params: &str) -> bool {
+    let Some(param) = params.split_whitespace().next() else {
+        return false;
+    };
+
+    first_statement(lines, line_num)
+        .and_then(|statement| statement.strip_prefix(param))
+        .and_then(|call| call.strip_prefix(".Skip"))
+        .is_some_and(|call| {
+            ["(", "f(", "Now("]
+                .iter()
+                .any(|rest| call.starts_with(rest))
+        })
+}
+
+/// Reports whether a function is one go test runs: named `Test` or `TestXxx`
+/// (or another --prefixes prefix, or `Benchmark`, `Fuzz` or `Example` for
+/// the other kinds) where Xxx does not start with a lowercase letter, without
+/// type parameters, and taking a single `*testing.T` (`*testing.B`,
+/// `*testing.F`, nothing for examples).
+fn is_test_function(
+    name: &str,
+    prefix: &str,
+    has_type_params: bool,
+    params: &str,
+    kind: Kind,
+) -> bool {
+    if has_type_params {
+        return false;
+    }
+
+    if name[prefix.len()..]
+        .chars()
+        .next()
+        .is_some_and(|c| c.is_lowercase())
+    {
+        return false;
+    }
+
+    let param_type = params
+        .trim()
+        .rsplit_once(char::is_whitespace)
+        .map_or(params.trim(), |(_, param_type)| param_type);
+
+    !params.contains(',') && param_type == kind.param_type()
+}
+
+/// Collects `t.Run` subtests, nesting the ones inside closures under their
+/// parent and following calls to same-file functions that take a `*testing.T`
+/// and to methods of same-file types that store one in a field.
+struct SubtestScanner<'a> {
+    lines: &'a [&'a str],
+    helpers: HashMap<&'a str, (usize, usize)>,
+    methods: HashMap<&'a str, (usize, usize)>,
+    patterns: &'a SubtestPatterns,
+}
+
+/// The regexes of the subtest scanner, compiled once per discovery rather
+/// than for every file.
+struct SubtestPatterns {
+    helper: Regex,
+    suite: Regex,
+    field: Regex,
+    method: Regex,
+    run: Regex,
+    call: Regex,
+    method_call: Regex,
+    range: Regex,
+    map_decl: Regex,
+    slice_range: Regex,
+    slice_decl: Regex,
+}
+
+impl SubtestPatterns {
+    fn new() -> Result<Self> {
+        Ok(SubtestPatterns {
+            helper: Regex::new(r"^func\s+(\w+)\s*(?:\[[^\]]*\])?\s*\([^)]*\*testing\.[TB]\b")?,
+            suite: Regex::new(r"^type\s+(\w+)\s+struct\b")?,
+            field: Regex::new(r"(?:^|[{;])\s*\w+(?:\s*,\s*\w+)*\s+\*testing\.[TB]\b")?,
+            method: Regex::new(r"^func\s*\(\s*(?:\w+\s+)?\*?\s*(\w+)\s*\)\s*(\w+)")?,
+            run: Regex::new(
+                r#"\.Run\s*\(\s*(?:"([^"]+)"|(\w+(?:\.\w+)?))\s*,\s*(?:(func)\b|(\w+)\s*\))?"#,
+            )?,
+            call: Regex::new(r"(?:^|[^.\w])([A-Za-z_]\w*)\s*\(")?,
+            method_call: Regex::new(r"\.([A-Za-z_]\w*)\s*\(")?,
+            range: Regex::new(r"\bfor\s+(\w+)\s*(?:,\s*\w+\s*)?:=\s*range\s+(map\[string\]|\w+)")?,
+            map_decl: Regex::new(r"\b(\w+)\s*:?=\s*map\[string\]")?,
+            slice_range: Regex::new(r"\bfor\s+\w+\s*,\s*(\w+)\s*:=\s*range\s+(\[\]|\w+)")?,
+            slice_decl: Regex::new(r"\b(\w+)\s*:?=\s*(\[\])")?,
+        })
+    }
+}
+
+impl<'a> SubtestScanner<'a> {
+    fn new(lines: &'a [&'a str], patterns: &'a SubtestPatterns) -> Self {
+        let mut helpers = HashMap::new();
+        for (line_num, line) in lines.iter().enumerate() {
+            if let Some(name) = patterns.helper.captures(line).and_then(|caps| caps.get(1)) {
+                helpers.insert(name.as_str(), (line_num, function_end(lines, line_num)));
+            }
+        }
+
+        // Suite-style types keep the test's `t` in a field, so their methods
+        // can call `s.t.Run`.
+        let mut suites = HashSet::new();
+        for (line_num, line) in lines.iter().enumerate() {
+            if let Some(name) = patterns.suite.captures(line).and_then(|caps| caps.get(1)) {
+                let end = function_end(lines, line_num).min(lines.len() - 1);
+                let mut fields = lines[line_num..=end]
+                    .iter()
+                    .map(|line| line.split_once("struct").map_or(*line, |(_, rest)| rest));
+                if fields.any(|fields| patterns.field.is_match(fields)) {
+                    suites.insert(name.as_str());
+                }
+            }
+        }
+
+        let mut methods = HashMap::new();
+        for (line_num, line) in lines.iter().enumerate() {
+            if let Some(caps) = patterns.method.captures(line)
+                && suites.contains(&caps[1])
+            {
+                let name = caps.get(2).unwrap().as_str();
+                methods.insert(name, (line_num, function_end(lines, line_num)));
+            }
+        }
+
+        SubtestScanner {
+            lines,
+            helpers,
+            methods,
+            patterns,
+        }
+    }
+
+    /// Collects the subtests between lines `start` and `end`. `bindings` are
+    /// the string literals passed at the call site for the parameters of the
+    /// helper being scanned, so that `t.Run(name, ...)` in a helper is named
+    /// after its caller's argument.
+    fn scan(
+        &self,
+        start: usize,
+        end: usize,
+        prefix: &str,
+        bindings: &Bindings<'a>,
+        visiting: &mut Vec<&'a str>,
+        subtests: &mut Vec<Subtest>,
+    ) {
+        let mut line_num = start;
+
+        while line_num < end.min(self.lines.len()) {
+            let line = self.lines[line_num];
+            let mut next_line = line_num + 1;
+
+            for caps in self.patterns.run.captures_iter(line) {
+                // A literal name, the keys of the map ranged over by the name
+                // variable, or a field of the structs in the slice ranged
+                // over, located at their entries. Names that cannot be
+                // resolved add no subtests.
+                let names = match (caps.get(1), caps.get(2)) {
+                    (Some(name), _) => vec![(name.as_str().to_string(), line_num, None)],
+                    (None, Some(var)) => match var.as_str().split_once('.') {
+                        Some((var, field)) => self.slice_cases(var, field, line_num),
+                        None => match bindings.get(var.as_str()) {
+                            Some((name, call_line)) => vec![(name.clone(), *call_line, None)],
+                            None => self.map_keys(var.as_str(), line_num),
+                        },
+                    },
+                    (None, None) => Vec::new(),
+                };
+                let closure_end = caps
+                    .get(3)
+                    .map(|_| function_end(self.lines, line_num))
+                    .filter(|&closure_end| closure_end > line_num);
+
+                for (name, name_line, case) in names {
+                    let name = format!("{}{}", prefix, name);
+                    let index = subtests.len();
+                    subtests.push(Subtest {
+                        name: name.clone(),
+                        line: name_line + 1,
+                        end_line: name_line + 1,
+                        case,
+                    });
+
+                    if let Some(closure_end) = closure_end {
+                        if name_line == line_num {
+                            subtests[index].end_line = closure_end.min(self.lines.len() - 1) + 1;
+                        }
+                        self.scan(
+                            line_num + 1,
+                            closure_end,
+                            &format!("{}/", name),
+                            bindings,
+                            visiting,
+                            subtests,
+                        );
+                    } else if let Some(helper) = caps.get(4) {
+                        self.scan_helper(
+                            &self.helpers,
+                            helper.as_str(),
+                            &format!("{}/", name),
+                            &Bindings::new(),
+                            visiting,
+                            subtests,
+                        );
+                    }
+                }
+
+                if let Some(closure_end) = closure_end {
+                    next_line = next_line.max(closure_end + 1);
+                }
+            }
+
+            if !self.patterns.run.is_match(line) {
+                for caps in self.patterns.call.captures_iter(line) {
+                    let name = caps.get(1).unwrap().as_str();
+                    let arguments = self.bind(
+                        &self.helpers,
+                        name,
+                        line_num,
+                        caps.get(0).unwrap().end(),
+                        bindings,
+                    );
+                    self.scan_helper(&self.helpers, name, prefix, &arguments, visiting, subtests);
+                }
+                for caps in self.patterns.method_call.captures_iter(line) {
+                    let name = caps.get(1).unwrap().as_str();
+                    let arguments = self.bind(
+                        &self.methods,
+                        name,
+                        line_num,
+                        caps.get(0).unwrap().end(),
+                        bindings,
+                    );
+                    self.scan_helper(&self.methods, name, prefix, &arguments, visiting, subtests);
+                }
+            }
+
+            line_num = next_line;
+        }
+    }
+
+    /// Resolves the keys of the map a `for key := range cases` loop above
+    /// `before` ranges over, when `cases` (or the ranged expression itself)
+    /// is a map literal with string keys. Returns each key with its line and
+    /// the source of its value, the case data of a table-driven test.
+    fn map_keys(&self, var: &str, before: usize) -> Vec<(String, usize, Option<String>)> {
+        let Some((range_line, ranged)) = (0..=before).rev().find_map(|line_num| {
+            let caps = self.patterns.range.captures(self.lines[line_num])?;
+            (&caps[1] == var).then(|| (line_num, caps[2].to_string()))
+        }) else {
+            return Vec::new();
+        };
+
+        let literal_line = if ranged == "map[string]" {
+            Some(range_line)
+        } else {
+            (0..range_line).rev().find(|&line_num| {
+                self.patterns
+                    .map_decl
+                    .captures_iter(self.lines[line_num])
+                    .any(|caps| caps[1] == ranged)
+            })
+        };
+        let Some(literal_line) = literal_line else {
+            return Vec::new();
+        };
+
+        // Keys are the quoted strings followed by a colon directly inside the
+        // literal's braces. A struct value type's braces come first and hold
+        // no such strings, so the scan ends once a brace group closes and
+        // something other than another `{` follows. A value runs from the
+        // key's colon to the next comma directly inside the literal's braces,
+        // or to the closing brace.
+        let mut keys = Vec::new();
+        let mut depth = 0;
+        let mut seen_brace = false;
+        let mut value_start = None;
+        let mut parens = 0;
+        let start = self.lines[literal_line].find("map[string]").unwrap_or(0);
+
+        for (line_num, line) in self.lines.iter().enumerate().skip(literal_line) {
+            let offset = if line_num == literal_line { start } else { 0 };
+            let text = &line[offset..];
+            let mut chars = text.char_indices().peekable();
+
+            while let Some((index, c)) = chars.next() {
+                match c {
+                    '{' => {
+                        depth += 1;
+                        seen_brace = true;
+                    }
+                    '(' | '[' if depth > 0 => parens += 1,
+                    ')' | ']' if depth > 0 => parens -= 1,
+                    '}' | ',' if depth == 1 && parens == 0 => {
+                        if let Some(from) = value_start.take()
+                            && let Some((_, _, case)) = keys.last_mut()
+                        {
+                            *case = Some(self.case_source(from, (line_num, offset + index)));
+                        }
+                        if c == '}' {
+                            depth -= 1;
+                        }
+                    }
+                    '}' => depth -= 1,
+                    '"' | '`' => {
+                        let end = text[index + 1..]
+                            .find(c)
+                            .map_or(text.len(), |end| index + 1 + end);
+                        if depth == 1
+                            && c == '"'
+                            && let Some(rest) = text.get(end + 1..)
+                            && rest.trim_start().starts_with(':')
+                        {
+                            keys.push((text[index + 1..end].to_string(), line_num, None));
+                            let colon = end + 1 + rest.find(':').unwrap();
+                            value_start = Some((line_num, offset + colon + 1));
+                        }
+                        while chars.next_if(|&(next, _)| next <= end).is_some() {}
+                    }
+                    c if depth == 0 && seen_brace && !c.is_whitespace() => return keys,
+                    _ => {}
+                }
+            }
+        }
+
+        keys
+    }
+
+    /// Resolves `var.field` names in a `for _, var := range cases` loop above
+    /// `before`, when `cases` (or the ranged expression itself) is a slice
+    /// literal of structs. Each entry that sets the field to a string literal,
+    /// by key or by position, gives a name with the entry's line and source.
+    /// Positions are known for `[]struct{...}` and for same-file struct types.
+    fn slice_cases(
+        &self,
+        var: &str,
+        field: &str,
+        before: usize,
+    ) -> Vec<(String, usize, Option<String>)> {
+        let Some((range_line, ranged, column)) = (0..=before).rev().find_map(|line_num| {
+            let caps = self.patterns.slice_range.captures(self.lines[line_num])?;
+            (&caps[1] == var).then(|| (line_num, caps[2].to_string(), caps.get(2).unwrap().start()))
+        }) else {
+            return Vec::new();
+        };
+
+        let (literal_line, column) = if ranged == "[]" {
+            (range_line, column)
+        } else {
+            let Some(found) = (0..range_line).rev().find_map(|line_num| {
+                self.patterns
+                    .slice_decl
+                    .captures_iter(self.lines[line_num])
+                    .find(|caps| caps[1] == ranged)
+                    .map(|caps| (line_num, caps.get(2).unwrap().start()))
+            }) else {
+                return Vec::new();
+            };
+            found
+        };
+
+        // The element type comes before the literal's brace: the fields of
+        // a `struct { ... }` are read on the way, a type name is looked up.
+        let mut fields = Vec::new();
+        let mut in_type = true;
+        let mut text = String::new();
+        let mut depth = 0;
+        let mut parens = 0;
+        let mut quote = None;
+        let mut entry = (0, 0);
+        let mut elements = Vec::new();
+        let mut element = String::new();
+        let mut cases = Vec::new();
+
+        for (line_num, line) in self.lines.iter().enumerate().skip(literal_line) {
+            let offset = if line_num == literal_line {
+                column + 2
+            } else {
+                0
+            };
+            let mut chars = line[offset..].char_indices().peekable();
+
+            while let Some((index, c)) = chars.next() {
+                let column = offset + index;
+                let buffer = if in_type { &mut text } else { &mut element };
+                match (quote, c) {
+                    (Some('"' | '\''), '\\') => {
+                        buffer.push(c);
+                        buffer.extend(chars.next().map(|(_, c)| c));
+                        continue;
+                    }
+                    (Some(q), c) if c == q => quote = None,
+                    (Some(_), _) => {}
+                    (None, '/') if chars.peek().is_some_and(|&(_, next)| next == '/') => break,
+                    (None, '"' | '`' | '\'') => quote = Some(c),
+                    (None, '{') if in_type && depth == 0 => {
+                        if text.trim() == "struct" {
+                            text.clear();
+                            depth = 1;
+                            continue;
+                        }
+                        if fields.is_empty() {
+                            fields = self.type_fields(text.trim().trim_start_matches('*'));
+                        }
+                        in_type = false;
+                        depth = 1;
+                        continue;
+                    }
+                    (None, '}') if in_type && depth == 1 => {
+                        fields = struct_fields(&text);
+                        text.clear();
+                        depth = 0;
+                        continue;
+                    }
+                    (None, '{') if !in_type && depth == 1 => {
+                        depth = 2;
+                        entry = (line_num, column);
+                        continue;
+                    }
+                    (None, '}') if !in_type && depth == 2 => {
+                        depth = 1;
+                        elements.push(std::mem::take(&mut element));
+                        let value = std::mem::take(&mut elements)
+                            .into_iter()
+                            .enumerate()
+                            .find_map(|(index, element)| match keyed_element(&element) {
+                                Some((key, value)) => (key == field).then(|| value.to_string()),
+                                None => (fields.get(index).is_some_and(|name| name == field))
+                                    .then(|| element.trim().to_string()),
+                            });
+                        if let Some(name) = value.as_deref().and_then(string_literal) {
+                            cases.push((
+                                name.to_string(),
+                                entry.0,
+                                Some(self.case_source(entry, (line_num, column + 1))),
+                            ));
+                        }
+                        continue;
+                    }
+                    (None, '}') if !in_type && depth == 1 => return cases,
+                    (None, '{') => depth += 1,
+                    (None, '}') => depth -= 1,
+                    (None, '(' | '[') => parens += 1,
+                    (None, ')' | ']') => parens -= 1,
+                    (None, ',') if !in_type && depth == 2 && parens == 0 => {
+                        elements.push(std::mem::take(&mut element));
+                        continue;
+                    }
+                    (None, _) => {}
+                }
+                if in_type || depth >= 2 {
+                    buffer.push(c);
+                }
+            }
+
+            if in_type {
+                text.push('\n');
+            } else if depth >= 2 {
+                element.push('\n');
+            }
+        }
+
+        cases
+    }
+
+    /// Returns the fields of the struct type `name` declared in the file, in
+    /// order, or none if it is not declared here.
+    fn type_fields(&self, name: &str) -> Vec<String> {
+        let Some(start) = self.lines.iter().position(|line| {
+            self.patterns
+                .suite
+                .captures(line)
+                .is_some_and(|caps| &caps[1] == name)
+        }) else {
+            return Vec::new();
+        };
+
+        let end = function_end(self.lines, start).min(self.lines.len() - 1);
+        let source = self.lines[start..=end].join("\n");
+        match (source.find('{'), source.rfind('}')) {
+            (Some(open), Some(close)) if open < close => struct_fields(&source[open + 1..close]),
+            _ => Vec::new(),
+        }
+    }
+
+    /// Returns the source between two (line, byte) positions, with the
+    /// indentation the lines after the first share removed and at most
+    /// MAX_CASE_LINES lines kept.
+    fn case_source(&self, from: (usize, usize), to: (usize, usize)) -> String {
+        let mut lines: Vec<&str> = self.lines[from.0..=to.0].to_vec();
+        let last = lines.len() - 1;
+        lines[last] = &lines[last][..to.1];
+        lines[0] = &lines[0][from.1..];
+
+        let indent = lines[1..]
+            .iter()
+            .filter(|line| !line.trim().is_empty())
+            .map(|line| line.len() - line.trim_start().len())
+            .min()
+            .unwrap_or(0);
+        let mut case: Vec<&str> = std::iter::once(lines[0].trim())
+            .chain(
+                lines[1..]
+                    .iter()
+                    .map(|line| line.get(indent..).unwrap_or("")),
+            )
+            .collect();
+
+        if case.len() > MAX_CASE_LINES {
+            let hidden = case.len() - MAX_CASE_LINES + 1;
+            case.truncate(MAX_CASE_LINES - 1);
+            return format!("{}\n... {} more lines", case.join("\n"), hidden);
+        }
+        case.join("\n").trim_end().to_string()
+    }
+
+    fn scan_helper(
+        &self,
+        helpers: &HashMap<&'a str, (usize, usize)>,
+        name: &str,
+        prefix: &str,
+        bindings: &Bindings<'a>,
+        visiting: &mut Vec<&'a str>,
+        subtests: &mut Vec<Subtest>,
+    ) {
+        let Some((&helper, &(start, end))) = helpers.get_key_value(name) else {
+            return;
+        };
+
+        // Guard against (mutually) recursive helpers.
+        if visiting.contains(&helper) {
+            return;
+        }
+
+        visiting.push(helper);
+        self.scan(start + 1, end, prefix, bindings, visiting, subtests);
+        visiting.pop();
+    }
+
+    /// Binds the parameters of the helper `name` to the string literals the
+    /// call starting at `column` of line `line_num` (just after its `(`)
+    /// passes for them, or to what a parameter passed on is bound to in
+    /// `outer`.
+    fn bind(
+        &self,
+        helpers: &HashMap<&'a str, (usize, usize)>,
+        name: &str,
+        line_num: usize,
+        column: usize,
+        outer: &Bindings<'a>,
+    ) -> Bindings<'a> {
+        let mut bindings = Bindings::new();
+        let Some(&(start, _)) = helpers.get(name) else {
+            return bindings;
+        };
+
+        let parameters = parameter_names(self.lines[start], name);
+        let arguments = call_arguments(self.lines, line_num, column);
+
+        for (parameter, argument) in parameters.into_iter().zip(arguments) {
+            let value = match string_literal(&argument) {
+                Some(literal) => Some((literal.to_string(), line_num)),
+                None => outer.get(argument.as_str()).cloned(),
+            };
+            if let Some(value) = value {
+                bindings.insert(parameter, value);
+            }
+        }
+
+        bindings
+    }
+}
+
+/// Returns the names of the fields declared in the body of a struct type, in
+/// order: `in, want int` declares two, an embedded `*pkg.Base` declares
+/// `Base`. Fields of nested struct types are left out.
+fn struct_fields(body: &str) -> Vec<String> {
+    let mut top = String::new();
+    let mut depth = 0;
+    for c in body.chars() {
+        match c {
+            '{' => depth += 1,
+            '}' => depth -= 1,
+            c if depth == 0 => top.push(c),
+            _ => {}
+        }
+    }
+
+    let mut fields = Vec::new();
+    for declaration in top.split(['\n', ';']) {
+        let declaration = declaration.split("//").next().unwrap_or("").trim();
+        if declaration.is_empty() {
+            continue;
+        }
+
+        let mut names = Vec::new();
+        let mut rest = declaration;
+        loop {
+            let end = rest
+                .find(|c: char| !(c.is_alphanumeric() || c == '_'))
+                .unwrap_or(rest.len());
+            names.push(&rest[..end]);
+            rest = rest[end..].trim_start();
+            match rest.strip_prefix(',') {
+                Some(after) => rest = after.trim_start(),
+                None => break,
+            }
+        }
+
+        if names[0].is_empty() || rest.is_empty() || rest.starts_with(['.', '[', '`', '"']) {
+            let embedded = declaration.split_whitespace().next().unwrap_or("");
+            let embedded = embedded.split('[').next().unwrap_or(embedded);
+            fields.push(
+                embedded
+                    .rsplit('.')
+                    .next()
+                    .unwrap_or("")
+                    .trim_start_matches('*')
+                    .to_string(),
+            );
+        } else {
+            fields.extend(names.into_iter().map(str::to_string));
+        }
+    }
+    fields
+}
+
+/// Splits a `key: value` element of a composite literal, or returns `None`
+/// for a positional one.
+fn keyed_element(element: &str) -> Option<(&str, &str)> {
+    let (key, value) = element.split_once(':')?;
+    let key = key.trim();
+    (!key.is_empty()
+        && key.chars().all(|c| c.is_alphanumeric() || c == '_')
+        && !value.starts_with('='))
+    .then(|| (key, value.trim()))
+}
+
+/// Helper parameters bound to a subtest name and the line it is given at.
+type Bindings<'a> = HashMap<&'a str, (String, usize)>;
+
+/// Returns the parameter names of the function or method `name` declared on
+/// `line`, e.g. `t` and `name` for `func check(t *testing.T, name string)`.
+fn parameter_names<'a>(line: &'a str, name: &str) -> Vec<&'a str> {
+    let Some(after_name) = line
+        .match_indices(name)
+        .map(|(index, _)| &line[index + name.len()..])
+        .find(|rest| rest.trim_start().starts_with(['(', '[']))
+    else {
+        return Vec::new();
+    };
+
+    // Skip type parameters.
+    let after_name = after_name.trim_start();
+    let params = match after_name.strip_prefix('[') {
+        Some(rest) => rest.split_once(']').map_or("", |(_, rest)| rest),
+        None => after_name,
+    };
+    let Some(params) = params.trim_start().strip_prefix('(') else {
+        return Vec::new();
+    };
+    let params = params.split_once(')').map_or(params, |(params, _)| params);
+
+    params
+        .split(',')
+        .filter_map(|param| param.split_whitespace().next())
+        .collect()
+}
+
+/// Splits the arguments of the call whose `(` ends just before `column` on
+/// line `line_num` at the top-level commas, following it onto later lines.
+fn call_arguments(lines: &[&str], line_num: usize, column: usize) -> Vec<String> {
+    let mut arguments = Vec::new();
+    let mut argument = String::new();
+    let mut depth = 0;
+    let mut quote = None;
+
+    let text = std::iter::once(&lines[line_num][column..])
+        .chain(lines[line_num + 1..].iter().copied().take(20));
+    for part in text {
+        let mut chars = part.chars();
+        while let Some(c) = chars.next() {
+            match (quote, c) {
+                (Some('"'), '\\') => {
+                    argument.push(c);
+                    argument.extend(chars.next());
+                    continue;
+                }
+                (Some(q), c) if c == q => quote = None,
+                (Some(_), _) => {}
+                (None, '"' | '`' | '\'') => quote = Some(c),
+                (None, '(' | '[' | '{') => depth += 1,
+                (None, ')' | ']' | '}') if depth == 0 => {
+                    arguments.push(argument.trim().to_string());
+                    return arguments;
+                }
+                (None, ')' | ']' | '}') => depth -= 1,
+                (None, ',') if depth == 0 => {
+                    arguments.push(std::mem::take(&mut argument).trim().to_string());
+                    continue;
+                }
+                (None, _) => {}
+            }
+            argument.push(c);
+        }
+        argument.push(' ');
+    }
+
+    arguments
+}
+
+/// Returns the contents of a Go string literal without escapes, `"name"` or
+/// `` `name` ``.
+fn string_literal(argument: &str) -> Option<&str> {
+    let literal = argument
+        .strip_prefix('"')
+        .and_then(|rest| rest.strip_suffix('"'))
+        .filter(|literal| !literal.contains(['\\', '"']))
+        .or_else(|| {
+            argument
+                .strip_prefix('`')
+                .and_then(|rest| rest.strip_suffix('`'))
+                .filter(|literal| !literal.contains('`'))
+        })?;
+
+    (!literal.is_empty()).then_some(literal)
+}
+
+/// Returns the directory containing `path` in a form `go test` accepts as a
+/// package argument.
+fn package_dir(path: &Path) -> String {
+    format_package_dir(path.parent().unwrap_or(Path::new("")))
+}
+
+fn format_package_dir(dir: &Path) -> String {
+    if dir.as_os_str().is_empty() {
+        return ".".to_string();
+    }
+
+    let dir = dir.to_string_lossy();
+    if dir.starts_with('.') || Path::new(dir.as_ref()).is_absolute() {
+        dir.to_string()
+    } else {
+        format!("./{}", dir)
+    }
+}
+
+/// Returns the line of the brace closing the function declared at `start`.
+/// In a file being edited the braces may not balance; a function still open
+/// when the next top-level `func` starts ends before it, so that it doesn't
+/// swallow the functions after it.
+fn function_end(lines: &[&str], start: usize) -> usize {
+    let mut brace_count = 0;
+    let mut in_function = false;
+
+    for (line_num, line) in lines.iter().enumerate().skip(start) {
+        if line_num > start && in_function && line.starts_with("func ") {
+            return line_num - 1;
+        }
+        if line.contains('{') {
+            brace_count += line.matches('{').count();
+            in_function = true;
+        }
+        if line.contains('}') {
+            brace_count = brace_count.saturating_sub(line.matches('}').count());
+        }
+
+        if in_function && brace_count == 0 {
+            return line_num;
+        }
+    }
+
+    lines.len()
+}
+
+fn lint_test_file(path: &Path, content: &str) -> Result<Vec<String>> {
+    let mut warnings = Vec::new();
+
+    let func_regex = Regex::new(r"^func\s+((Test|Benchmark|Example)\w*)\s*\(([^)]*)\)")?;
+
+    let lines: Vec<&str> = content.lines().collect();
+
+    for (line_num, line) in lines.iter().enumerate() {
+        let Some(caps) = func_regex.captures(line) else {
+            continue;
+        };
+
+        let name = &caps[1];
+        let param = caps[3].split_whitespace().next().unwrap_or("");
+
+        let end = function_end(&lines, line_num).min(lines.len().saturating_sub(1));
+        let body = lines[line_num..=end].join("\n");
+        let body = body.split_once('{').map_or("", |(_, rest)| rest);
+
+        let message = match &caps[2] {
+            "Test" if !param.is_empty() && param != "_" && !uses_identifier(body, param)? => {
+                format!("{} never uses {}, so it cannot fail", name, param)
+            }
+            "Test" if !param.is_empty() && param != "_" && !has_assertions(body, param)? => {
+                format!(
+                    "{} has no apparent assertions, possibly empty (heuristic)",
+                    name
+                )
+            }
+            "Benchmark"
+                if !param.is_empty()
+                    && !body.contains(&format!("{}.N", param))
+                    && !body.contains(&format!("{}.Loop()", param)) =>
+            {
+                format!("{} never loops over {}.N", name, param)
+            }
+            "Example" if !body.contains("// Output:") && !body.contains("// Unordered output:") => {
+                format!("{} has no // Output: comment and will not be run", name)
+            }
+            _ => continue,
+        };
+
+        warnings.push(format!(
+            "{}:{}: warning: {}",
+            path.to_string_lossy(),
+            line_num + 1,
+            message
+        ));
+    }
+
+    Ok(warnings)
+}
+
+/// Guesses whether a test body can fail: it calls a failing or skipping
+/// method on `param`, runs subtests, uses testify's require/assert, or hands
+/// `param` to another function that might.
+fn has_assertions(body: &str, param: &str) -> Result<bool> {
+    let param = regex::escape(param);
+    let assertion_regex = Regex::new(&format!(
+        r"\b{param}\.(Error|Errorf|Fatal|Fatalf|Fail|FailNow|Skip|Skipf|SkipNow|Run)\b|\b(require|assert)\.\w+\(|[(,]\s*{param}\s*[,)]"
+    ))?;
+    Ok(assertion_regex.is_match(body))
+}
+
+fn uses_identifier(body: &str, ident: &str) -> Result<bool> {
+    let ident_regex = Regex::new(&format!(r"\b{}\b", regex::escape(ident)))?;
+    Ok(ident_regex.is_match(body))
+}
+
+fn diff_patterns(
+    old_dir: &str,
+    new_dir: &str,
+    args: &Args,
+    options: &DiscoveryOptions,
+) -> Result<()> {
+    let old_tests = discover(&[old_dir], args, options, &mut ParseCache::default())?;
+    let new_tests = discover(&[new_dir], args, options, &mut ParseCache::default())?;
+
+    let old_patterns: BTreeSet<String> = collect_test_patterns(&old_tests).into_iter().collect();
+    let new_patterns: BTreeSet<String> = collect_test_patterns(&new_tests).into_iter().collect();
+
+    for pattern in old_patterns.difference(&new_patterns) {
+        println!("- {}", anchored(pattern, args).replace('/', &args.sep));
+    }
+    for pattern in new_patterns.difference(&old_patterns) {
+        println!("+ {}", anchored(pattern, args).replace('/', &args.sep));
+    }
+
+    Ok(())
+}
+
+/// Checks discovery against the go tool: parses `dirs` without the cache and
+/// compares the top-level names of the kinds being listed with `go test
+/// -list` per package. Packages the go tool cannot list, e.g. because they
+/// don't build, are reported and skipped.
+fn verify(dirs: &[&str], options: &DiscoveryOptions) -> Result<()> {
+    let tests = find_tests(dirs, options, &mut ParseCache::default())?;
+
+    let mut parsed: BTreeMap<PathBuf, (String, BTreeSet<String>)> = BTreeMap::new();
+    for test in &tests {
+        // Functions of other --prefixes are not go tests.
+        if test.kind == Kind::Test && !test.name.starts_with("Test") {
+            continue;
+        }
+        parsed
+            .entry(affected::canonical(Path::new(&test.package)))
+            .or_insert_with(|| (test.package.clone(), BTreeSet::new()))
+            .1
+            .insert(test.name.clone());
+    }
+
+    let mut listed = BTreeMap::new();
+    for dir in dirs {
+        listed.extend(golist::list_tests(
+            glob::base(dir),
+            options.build.tags.default_tags(),
+        )?);
+    }
+
+    let mut mismatches = 0;
+    for (pkg_dir, names) in &listed {
+        let names: BTreeSet<String> = names
+            .iter()
+            .filter(|name| options.kinds.contains(&Kind::of_name(name)))
+            .cloned()
+            .collect();
+        let (package, found) = parsed
+            .remove(pkg_dir)
+            .unwrap_or_else(|| (format_package_dir(pkg_dir), BTreeSet::new()));
+
+        for name in names.difference(&found) {
+            println!("missed   {}  {}", package, name);
+            mismatches += 1;
+        }
+        for name in found.difference(&names) {
+            println!("phantom  {}  {}", package, name);
+            mismatches += 1;
+        }
+    }
+
+    for (package, _) in parsed.values() {
+        eprintln!("note: go test -list could not list {}, skipped", package);
+    }
+
+    if mismatches > 0 {
+        println!(
+            "{} mismatch(es) between parsing and go test -list in {} package(s)",
+            mismatches,
+            listed.len()
+        );
+        std::process::exit(1);
+    }
+
+    println!(
+        "Parsing matches go test -list in {} package(s)",
+        listed.len()
+    );
+    Ok(())
+}
+
+/// Returns `pattern` as it is listed: between ^ and $ unless --no-anchor.
+fn anchored(pattern: &str, args: &Args) -> String {
+    if args.no_anchor {
+        pattern.to_string()
+    } else {
+        format!("^{}$", pattern)
+    }
+}
+
+fn print_tests(tests: &[TestInfo], args: &Args) {
+    let show_parent = args.parent && !args.only_subtests;
+    let print = |pattern: String, note: String| {
+        let line = anchored(&pattern, args);
+        if args.explain {
+            explain_pattern(&pattern, &line, tests);
+        }
+        println!("{}{}", line.replace('/', &args.sep), note);
+    };
+
+    for test in tests {
+        if test.subtests.is_empty() || show_parent {
+            let mut note = match seed_corpus(test) {
+                _ if args.fuzz_corpus.is_none() || test.kind != Kind::Fuzz => String::new(),
+                Some(files) if files > 0 => format!("\tseed corpus: {} file(s)", files),
+                _ => "\tno seed corpus".to_string(),
+            };
+            if args.fixtures && !test.fixtures.is_empty() {
+                note.push_str(&format!("\tfixtures: {}", test.fixtures.join(", ")));
+            }
+            print(test.name.clone(), note);
+        }
+        if args.subtests {
+            for subtest in &test.subtests {
+                print(format!("{}/{}", test.name, subtest.name), String::new());
+            }
+        }
+    }
+}
+
+/// A code lens: a test or subtest declared in the file, and the command that
+/// runs just it from `dir`.
+#[derive(Serialize)]
+struct Lens {
+    line: usize,
+    end_line: usize,
+    name: String,
+    kind: Kind,
+    dir: String,
+    command: Vec<String>,
+}
+
+/// Prints the lenses of a single file as JSON lines, ordered by line.
+fn print_lens(
+    file: &str,
+    args: &Args,
+    options: &DiscoveryOptions,
+    run_options: &RunOptions,
+) -> Result<()> {
+    let tests = discover(&[file], args, options, &mut ParseCache::default())?;
+    let mut lenses = Vec::new();
+
+    for test in tests.iter().filter(|test| test.line > 0) {
+        let dir = affected::canonical(Path::new(&test.package));
+        let tags = run_options.tags.for_path(Path::new(&test.file));
+
+        let positions = std::iter::once((test.name.clone(), test.line, test.end_line)).chain(
+            test.subtests.iter().map(|subtest| {
+                let name = format!("{}/{}", test.name, subtest.name);
+                (name, subtest.line, subtest.end_line)
+            }),
+        );
+
+        for (name, line, end_line) in positions {
+            let pattern = build_run_pattern(std::slice::from_ref(&name), run_options.anchor);
+            let cmd = go_test_command(&pattern, &[".".to_string()], tags, run_options);
+
+            lenses.push(Lens {
+                line,
+                end_line,
+                name,
+                kind: test.kind,
+                dir: dir.to_string_lossy().to_string(),
+                command: std::iter::once(cmd.get_program())
+                    .chain(cmd.get_args())
+                    .map(|arg| arg.to_string_lossy().to_string())
+                    .collect(),
+            });
+        }
+    }
+
+    lenses.sort_by_key(|lens| lens.line);
+
+    let mut stdout = io::stdout().lock();
+    for lens in &lenses {
+        serde_json::to_writer(&mut stdout, lens)?;
+        writeln!(stdout)?;
+    }
+
+    Ok(())
+}
+
+/// Prints the ports each test would be built on, regardless of --goos and
+/// --goarch. Every port is summarized as "all". `options` must have
+/// `any_platform` set, so that the files of every platform are read.
+fn list_platforms(dirs: &[&str], args: &Args, options: &DiscoveryOptions) -> Result<()> {
+    let mut tests = find_tests(dirs, options, &mut ParseCache::default())?;
+    exclude_tests(&mut tests, &options.exclude);
+    exclude_under(&mut tests, &options.dir_exclude);
+
+    let mut ports: HashMap<String, Vec<String>> = HashMap::new();
+    for test in &tests {
+        if !ports.contains_key(&test.file) {
+            let path = Path::new(&test.file);
+            let content =
+                std::fs::read_to_string(path).map_err(|err| DiscoveryError::read(path, err))?;
+            ports.insert(
+                test.file.clone(),
+                platform::building_ports(path, &content, &options.build.tags),
+            );
+        }
+        let ports = &ports[&test.file];
+
+        if args.ndjson {
+            println!(
+                "{}",
+                serde_json::json!({
+                    "name": test.name,
+                    "file": test.file,
+                    "line": test.line,
+                    "package": test.package,
+                    "platforms": ports,
+                })
+            );
+        } else if ports.len() == platform::port_count() {
+            println!("{}\t{}:{}\tall", test.name, test.file, test.line);
+        } else if ports.is_empty() {
+            println!("{}\t{}:{}\tnone", test.name, test.file, test.line);
+        } else {
+            println!(
+                "{}\t{}:{}\t{}",
+                test.name,
+                test.file,
+                test.line,
+                ports.join(",")
+            );
+        }
+    }
+
+    Ok(())
+}
+
+/// Prints counts in the Prometheus text format, labeled by package import
+/// path (or directory outside a module) and kind.
+fn print_metrics(tests: &[TestInfo]) {
+    let mut import_paths = HashMap::new();
+    let mut counts: BTreeMap<(String, &str), (usize, usize)> = BTreeMap::new();
+
+    for test in tests {
+        let package = import_paths
+            .entry(test.package.clone())
+            .or_insert_with(|| {
+                gomod::import_path(Path::new(&test.package)).unwrap_or(test.package.clone())
+            })
+            .clone();
+
+        let count = counts.entry((package, test.kind.as_str())).or_default();
+        count.0 += 1;
+        count.1 += test.subtests.len();
+    }
+
+    println!("# HELP gotest_tests_total Top-level test functions found.");
+    println!("# TYPE gotest_tests_total gauge");
+    for ((package, kind), (tests, _)) in &counts {
+        println!(
+            "gotest_tests_total{{package=\"{}\",kind=\"{}\"}} {}",
+            escape_label(package),
+            kind,
+            tests
+        );
+    }
+
+    println!("# HELP gotest_subtests_total Subtests found by parsing t.Run calls.");
+    println!("# TYPE gotest_subtests_total gauge");
+    for ((package, kind), (_, subtests)) in &counts {
+        println!(
+            "gotest_subtests_total{{package=\"{}\",kind=\"{}\"}} {}",
+            escape_label(package),
+            kind,
+            subtests
+        );
+    }
+}
+
+fn escape_label(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
+
+/// Prints `pattern\tfile\tline\tpackage\tkind` per test and subtest. The
+/// columns are a stable interface for external tools, so new ones may only be
+/// appended.
+fn print_tsv(tests: &[TestInfo]) {
+    for test in tests {
+        let kind = test.kind.as_str();
+        println!(
+            "{}\t{}\t{}\t{}\t{}",
+            test.name, test.file, test.line, test.package, kind
+        );
+        for subtest in &test.subtests {
+            println!(
+                "{}/{}\t{}\t{}\t{}\t{}",
+                test.name, subtest.name, test.file, subtest.line, test.package, kind
+            );
+        }
+    }
+}
+
+fn print_files(tests: &[TestInfo]) {
+    let mut seen = HashSet::new();
+
+    // Tests only known from go test -list have no file of their own.
+    for test in tests.iter().filter(|test| test.line > 0) {
+        if seen.insert(test.file.as_str()) {
+            println!("{}", test.file);
+        }
+    }
+}
+
+/// Prints the directories with Go files that would be built but none of the
+/// discovered tests. Like `./...`, directories named vendor or testdata or
+/// starting with `.` or `_` are not searched.
+fn print_untested(dirs: &[&str], tests: &[TestInfo], options: &DiscoveryOptions) -> Result<()> {
+    let tested: HashSet<&str> = tests.iter().map(|test| test.package.as_str()).collect();
+    let mut untested = BTreeSet::new();
+
+    for root in glob::distinct_roots(dirs)? {
+        let walk = WalkDir::new(&root)
+            .max_depth(if options.recurse { usize::MAX } else { 1 })
+            .sort_by_file_name()
+            .into_iter()
+            .filter_entry(|entry| {
+                let name = entry.file_name().to_string_lossy();
+                entry.depth() == 0
+                    || !entry.file_type().is_dir()
+                    || !(name == "vendor"
+                        || name == "testdata"
+                        || name.starts_with('.')
+                        || name.starts_with('_'))
+            });
+
+        for entry in walk {
+            let entry = entry.map_err(|err| DiscoveryError::walk(&root.to_string_lossy(), err))?;
+            let path = entry.path();
+            let name = entry.file_name().to_string_lossy();
+            if !entry.file_type().is_file()
+                || !name.ends_with(".go")
+                || name.ends_with("_test.go")
+                || name.starts_with(['.', '_'])
+                || !options.build.matches_file_name(path)
+            {
+                continue;
+            }
+
+            let package = package_dir(path);
+            if tested.contains(package.as_str()) || untested.contains(&package) {
+                continue;
+            }
+            let content =
+                std::fs::read_to_string(path).map_err(|err| DiscoveryError::read(path, err))?;
+            if options.build.matches_constraints(path, &content) {
+                untested.insert(package);
+            }
+        }
+    }
+
+    for package in untested {
+        println!("{}", package);
+    }
+
+    Ok(())
+}
+
+/// Prints, for each of `patterns` in each package declaring it, the go test
+/// command that runs just that test there, with the tags, flags and
+/// environment a run would use.
+fn print_commands(tests: &[TestInfo], patterns: &[String], options: &RunOptions) {
+    for test in tests {
+        for pattern in selected_patterns(test, patterns) {
+            let cmd = go_test_command(
+                &build_run_pattern(std::slice::from_ref(&pattern), options.anchor),
+                std::slice::from_ref(&test.package),
+                options.tags.for_path(Path::new(&test.file)),
+                options,
+            );
+
+            let words: Vec<String> = options
+                .env
+                .iter()
+                .map(|(key, value)| format!("{}={}", key, shell_quote(value)))
+                .chain(options.wrapper.iter().map(|arg| shell_quote(arg)))
+                .chain(std::iter::once("go".to_string()))
+                .chain(
+                    cmd.get_args()
+                        .map(|arg| shell_quote(&arg.to_string_lossy())),
+                )
+                .collect();
+            println!("{}", words.join(" "));
+        }
+    }
+}
+
+/// Quotes `word` for a POSIX shell when it contains anything but characters
+/// that are safe unquoted.
+fn shell_quote(word: &str) -> String {
+    let safe = |c: char| c.is_ascii_alphanumeric() || "-_./=:,+@%".contains(c);
+
+    if !word.is_empty() && word.chars().all(safe) {
+        word.to_string()
+    } else {
+        format!("'{}'", word.replace('\'', "'\\''"))
+    }
+}
+
+/// Prints the run file of --gen-testmain: a comment line, then for each
+/// package directory with tests, sorted, the directory, its build tags
+/// (empty without any) and a -run pattern selecting all its tests, separated
+/// by tabs.
+fn print_run_file(tests: &[TestInfo], options: &RunOptions) {
+    let mut packages: BTreeMap<&str, Vec<TestInfo>> = BTreeMap::new();
+    for test in tests {
+        packages
+            .entry(&test.package)
+            .or_default()
+            .push(test.clone());
+    }
+
+    println!("# package\ttags\trun pattern");
+    for (package, group) in packages {
+        let patterns = collect_test_patterns(&group);
+        println!(
+            "{}\t{}\t{}",
+            package,
+            options.tags.for_path(Path::new(package)).unwrap_or(""),
+            build_run_pattern(&patterns, options.anchor)
+        );
+    }
+}
+
+/// Prints the import path of each package directory once, sorted, or the
+/// directory itself when it is outside a module, for use as in
+/// `go test $(gotestfinder --packages .)`.
+fn print_packages(dirs: impl IntoIterator<Item = String>) {
+    let packages: BTreeSet<String> = dirs
+        .into_iter()
+        .map(|dir| gomod::import_path(Path::new(&dir)).unwrap_or(dir))
+        .collect();
+
+    for package in packages {
+        println!("{}", package);
+    }
+}
+
+fn print_ndjson(tests: &[TestInfo]) -> Result<()> {
+    let mut stdout = io::stdout().lock();
+
+    for test in tests {
+        serde_json::to_writer(&mut stdout, test)?;
+        writeln!(stdout)?;
+    }
+
+    Ok(())
+}
+
+fn print_document(tests: &[TestInfo], format: OutputFormat) -> Result<()> {
+    match format {
+        OutputFormat::Json => println!("{}", serde_json::to_string_pretty(tests)?),
+        OutputFormat::Yaml => print!("{}", yaml::to_string(&serde_json::to_value(tests)?)),
+        OutputFormat::Toml => {
+            // A TOML document is a table, so the tests go in a `tests` array.
+            #[derive(Serialize)]
+            struct Document<'a> {
+                tests: &'a [TestInfo],
+            }
+
+            print!("{}", toml::to_string(&Document { tests })?);
+        }
+    }
+
+    Ok(())
+}
+
+/// Returns the JSON Schema of a serialized `TestInfo`. Keep it in step with
+/// the fields of `TestInfo`, `Subtest` and `Kind`.
+fn test_schema() -> serde_json::Value {
+    let integer = |description: &str| serde_json::json!({ "type": "integer", "minimum": 0, "description": description });
+    let flag =
+        |description: &str| serde_json::json!({ "type": "boolean", "description": description });
+    let strings = |description: &str| serde_json::json!({ "type": "array", "items": { "type": "string" }, "description": description });
+
+    serde_json::json!({
+        "$schema": "https://json-schema.org/draft/2020-12/schema",
+        "title": "gotestfinder test",
+        "description": "A discovered test, benchmark, fuzz target or example",
+        "type": "object",
+        "properties": {
+            "name": { "type": "string", "description": "Function name, e.g. TestParse" },
+            "file": { "type": "string", "description": "Declaring file, or the package directory for tests only known from go test -list" },
+            "line": integer("1-based line of the declaration, 0 when only known from go test -list"),
+            "end_line": integer("Line of the closing brace"),
+            "package": { "type": "string", "description": "Package directory, e.g. ./pkg/parser" },
+            "external": flag("Whether the file is in the external foo_test package"),
+            "kind": { "enum": ["test", "benchmark", "fuzz", "example"] },
+            "doc_tags": strings("Tags from a // tags: a, b line in the doc comment"),
+            "skipped": flag("Whether the body starts with t.Skip, t.Skipf or t.SkipNow"),
+            "focused": flag("Whether the doc comment has a //testtool:focus directive"),
+            "generated": flag("Whether the file has a // Code generated ... DO NOT EDIT. header"),
+            "documented": flag("Whether there is a doc comment, not counting directives"),
+            "helper": flag("Whether the body starts with t.Helper()"),
+            "size": integer("Bytes from the declaration to the closing brace, 0 when only known from go test -list"),
+            "fixtures": strings("Paths under testdata named by string literals in the body, as written"),
+            "owners": strings("Owners of the file according to CODEOWNERS"),
+            "subtests": {
+                "type": "array",
+                "items": { "$ref": "#/$defs/subtest" },
+                "description": "Subtests at any depth"
+            }
+        },
+        "required": [
+            "name", "file", "line", "end_line", "package", "external", "kind", "doc_tags",
+            "skipped", "focused", "generated", "documented", "helper", "size", "fixtures", "owners",
+            "subtests"
+        ],
+        "additionalProperties": false,
+        "$defs": {
+            "subtest": {
+                "type": "object",
+                "properties": {
+                    "name": { "type": "string", "description": "Name below the test, with / between levels, e.g. outer/inner" },
+                    "line": integer("Line of the t.Run call"),
+                    "end_line": integer("Line where its closure ends"),
+                    "case": {
+                        "type": ["string", "null"],
+                        "description": format!(
+                            "Source of the table entry a table-driven subtest is named after, at most {} lines",
+                            MAX_CASE_LINES
+                        )
+                    }
+                },
+                "required": ["name", "line", "end_line"],
+                "additionalProperties": false
+            }
+        }
+    })
+}
+
+fn run_with_skim(tests: Vec<TestInfo>, options: &RunOptions) -> Result<()> {
+    let test_patterns = candidate_patterns(&tests, options);
+
+    if test_patterns.is_empty() {
+        println!("No tests found");
+        return Ok(());
+    }
+
+    let selected_tests = skim_select(&test_patterns, &tests, options)?;
+
+    if selected_tests.is_empty() {
+        println!("No tests selected");
+        return Ok(());
+    }
+
+    if options.print_packages {
+        print_packages(selected_packages(&tests, &selected_tests));
+        return Ok(());
+    }
+
+    if options.print_commands {
+        print_commands(&tests, &selected_tests, options);
+        return Ok(());
+    }
+
+    if options.confirm && !confirm_run(&tests, &selected_tests, options)? {
+        println!("Not running");
+        return Ok(());
+    }
+
+    let mut code = if options.debug_test {
+        debug_test(&tests, &selected_tests, options)?
+    } else {
+        run_selection(&tests, &selected_tests, options)?
+    };
+
+    if options.repl {
+        code = repl(&tests, &selected_tests, options, code)?;
+    }
+
+    if code != 0 {
+        std::process::exit(code);
+    }
+
+    Ok(())
+}
+
+/// Shows the go test command for the selection and asks whether to run it.
+/// Without a terminal on stdin there is nobody to ask, so it runs.
+fn confirm_run(
+    tests: &[TestInfo],
+    selected_tests: &[String],
+    options: &RunOptions,
+) -> Result<bool> {
+    if !io::stdin().is_terminal() {
+        return Ok(true);
+    }
+
+    let packages = if options.tidy {
+        selected_packages(tests, selected_tests)
+    } else {
+        Vec::new()
+    };
+    let cmd = go_test_command(
+        &build_run_pattern(selected_tests, options.anchor),
+        &packages,
+        options.tags.default_tags(),
+        options,
+    );
+
+    eprintln!(
+        "{} test(s) selected: go {}",
+        selected_tests.len(),
+        cmd.get_args()
+            .map(|arg| arg.to_string_lossy())
+            .collect::<Vec<_>>()
+            .join(" ")
+    );
+    eprint!("Run? [y/N] ");
+    io::stderr().flush()?;
+
+    let mut answer = String::new();
+    io::stdin().read_line(&mut answer)?;
+    Ok(matches!(answer.trim(), "y" | "Y" | "yes"))
+}
+
+/// Starts delve on the one selected test, in its package directory so that
+/// relative paths in the test resolve as under go test.
+fn debug_test(tests: &[TestInfo], selected_tests: &[String], options: &RunOptions) -> Result<i32> {
+    if selected_tests.len() != 1 {
+        anyhow::bail!(
+            "--debug-test needs exactly one selected test, got {}",
+            selected_tests.len()
+        );
+    }
+
+    let owners: Vec<&TestInfo> = tests
+        .iter()
+        .filter(|test| !selected_patterns(test, selected_tests).is_empty())
+        .collect();
+    let [test] = owners.as_slice() else {
+        anyhow::bail!(
+            "{} is declared in {} packages, --debug-test needs a single one",
+            selected_tests[0],
+            owners.len()
+        );
+    };
+
+    let pattern = build_run_pattern(selected_tests, options.anchor);
+    if options.explain {
+        explain_pattern(&selected_tests[0], &pattern, tests);
+    }
+
+    let mut cmd = Command::new("dlv");
+    cmd.arg("test").current_dir(&test.package);
+    if let Some(tags) = options.tags.for_path(Path::new(&test.file)) {
+        cmd.arg(format!("--build-flags=-tags={}", tags));
+    }
+    cmd.arg("--");
+    if test.kind == Kind::Benchmark {
+        cmd.args(["-test.run", "^$", "-test.bench", &pattern]);
+    } else {
+        cmd.args(["-test.run", &pattern]);
+    }
+    cmd.envs(options.env.iter().map(|(key, value)| (key, value)));
+
+    println!(
+        "Debugging in {}: dlv {}",
+        test.package,
+        cmd.get_args()
+            .map(|arg| arg.to_string_lossy())
+            .collect::<Vec<_>>()
+            .join(" ")
+    );
+
+    let status = cmd
+        .status()
+        .context("failed to start dlv, is delve installed? (go install github.com/go-delve/delve/cmd/dlv@latest)")?;
+
+    Ok(status.code().unwrap_or(1))
+}
+
+/// Returns `text` as a Go interpreted string literal, escaping quotes,
+/// backslashes and control characters like strconv.Quote.
+fn go_quote(text: &str) -> String {
+    let mut quoted = String::from('"');
+    for c in text.chars() {
+        match c {
+            '"' => quoted.push_str("\\\""),
+            '\\' => quoted.push_str("\\\\"),
+            '\n' => quoted.push_str("\\n"),
+            '\r' => quoted.push_str("\\r"),
+            '\t' => quoted.push_str("\\t"),
+            '\u{7}' => quoted.push_str("\\a"),
+            '\u{8}' => quoted.push_str("\\b"),
+            '\u{c}' => quoted.push_str("\\f"),
+            '\u{b}' => quoted.push_str("\\v"),
+            c if (c as u32) < 0x20 || c == '\u{7f}' => {
+                quoted.push_str(&format!("\\x{:02x}", c as u32))
+            }
+            c if c.is_control() || matches!(c, '\u{2028}' | '\u{2029}' | '\u{feff}') => {
+                quoted.push_str(&format!("\\u{:04x}", c as u32))
+            }
+            c => quoted.push(c),
+        }
+    }
+    quoted.push('"');
+    quoted
+}
+
+/// Asks for a test and a subtest name, appends an empty `t.Run` with that
+/// name to the end of the test's body and opens the editor inside it.
+fn scaffold_subtest(tests: &[TestInfo], options: &RunOptions) -> Result<()> {
+    // Fuzz targets and examples have no Run method to add subtests with.
+    let candidates: Vec<String> = tests
+        .iter()
+        .filter(|test| test.line > 0 && matches!(test.kind, Kind::Test | Kind::Benchmark))
+        .map(|test| test.name.clone())
+        .collect();
+
+    if candidates.is_empty() {
+        println!("No tests found");
+        return Ok(());
+    }
+
+    let Some(selected) = skim_select(&candidates, tests, options)?.into_iter().next() else {
+        println!("No tests selected");
+        return Ok(());
+    };
+    let test = tests
+        .iter()
+        .find(|test| test.name == selected && test.line > 0)
+        .context("selected test not found")?;
+
+    eprint!("Subtest name: ");
+    io::stderr().flush()?;
+    let mut name = String::new();
+    io::stdin().read_line(&mut name)?;
+    let name = name.trim();
+    if name.is_empty() {
+        println!("No subtest name given");
+        return Ok(());
+    }
+
+    let content = std::fs::read_to_string(&test.file)?;
+    let mut lines: Vec<&str> = content.lines().collect();
+
+    let param = Regex::new(r"\(\s*(\w+)\s+\*testing\.[TB]\b")?
+        .captures(lines[test.line - 1])
+        .map(|caps| caps[1].to_string())
+        .filter(|param| param != "_")
+        .with_context(|| format!("{} has no named testing parameter", test.name))?;
+
+    // The closing brace must be on its own line to insert before it.
+    let end = test.end_line - 1;
+    let closing = lines[end];
+    if test.end_line == test.line || closing.trim() != "}" {
+        anyhow::bail!(
+            "cannot find the closing brace of {} on a line of its own",
+            test.name
+        );
+    }
+
+    let indent = &closing[..closing.len() - closing.trim_start().len()];
+    let opening = format!(
+        "{}\t{}.Run({}, func({} {}) {{",
+        indent,
+        param,
+        go_quote(name),
+        param,
+        test.kind.param_type()
+    );
+    let closing_run = format!("{}\t}})", indent);
+    lines.splice(end..end, [opening.as_str(), "", closing_run.as_str()]);
+
+    let mut updated = lines.join("\n");
+    if content.ends_with('\n') {
+        updated.push('\n');
+    }
+    std::fs::write(&test.file, updated)?;
+
+    // The empty line inside the new closure.
+    let cursor = end + 2;
+    println!("Added {}/{} at {}:{}", test.name, name, test.file, cursor);
+
+    let editor = std::env::var("VISUAL")
+        .ok()
+        .filter(|editor| !editor.trim().is_empty())
+        .or_else(|| std::env::var("EDITOR").ok())
+        .filter(|editor| !editor.trim().is_empty())
+        .unwrap_or_else(|| "vi".to_string());
+    let mut words = editor.split_whitespace();
+    let program = words.next().unwrap_or("vi");
+
+    let status = Command::new(program)
+        .args(words)
+        .arg(format!("+{}", cursor))
+        .arg(&test.file)
+        .status()
+        .with_context(|| format!("failed to start editor {:?}", program))?;
+
+    if !status.success() {
+        eprintln!("warning: {} exited with {}", program, status);
+    }
+
+    Ok(())
+}
+
+fn run_changed(tests: &[TestInfo], dirs: &[&str], base: &str, options: &RunOptions) -> Result<()> {
+    let mut changed = HashMap::new();
+    for dir in dirs {
+        changed.extend(affected::changed_lines(glob::base(dir), base)?);
+    }
+
+    let selected_tests: Vec<String> = tests
+        .iter()
+        .flat_map(|test| changed_patterns(test, &changed))
+        .collect();
+
+    if selected_tests.is_empty() {
+        println!("No tests changed since {}", base);
+        return Ok(());
+    }
+
+    let code = run_selection(tests, &selected_tests, options)?;
+
+    if code != 0 {
+        std::process::exit(code);
+    }
+
+    Ok(())
+}
+
+/// Runs the tests of the `count` most recently modified test files, going by
+/// the modification times recorded while walking.
+fn run_recent(
+    tests: &[TestInfo],
+    cache: &ParseCache,
+    count: usize,
+    options: &RunOptions,
+) -> Result<()> {
+    let mut files: Vec<(&Path, SystemTime)> = cache
+        .files
+        .iter()
+        .filter(|(path, _)| tests.iter().any(|test| Path::new(&test.file) == *path))
+        .map(|(path, cached)| (path.as_path(), cached.modified))
+        .collect();
+    files.sort_by(|(_, a), (_, b)| b.cmp(a));
+    files.truncate(count);
+
+    let recent: Vec<&TestInfo> = tests
+        .iter()
+        .filter(|test| files.iter().any(|(path, _)| *path == Path::new(&test.file)))
+        .collect();
+
+    if recent.is_empty() {
+        println!("No tests found");
+        return Ok(());
+    }
+
+    for (path, _) in &files {
+        println!("Recently modified: {}", path.display());
+    }
+
+    let selected_tests: Vec<String> = recent.iter().map(|test| test.name.clone()).collect();
+    let code = run_selection(tests, &selected_tests, options)?;
+
+    if code != 0 {
+        std::process::exit(code);
+    }
+
+    Ok(())
+}
+
+/// Runs what is on the clipboard in all packages: the -run value of a go
+/// test command, or patterns as gotestfinder prints them, one per line.
+fn run_from_clipboard(options: &RunOptions) -> Result<i32> {
+    let text = clipboard::read()?;
+    let run_pattern = clipboard_run_pattern(&text, options.anchor)?;
+
+    let status = execute_go_test(&run_pattern, &[], options.tags.default_tags(), options)?;
+    Ok(status
+        .code()
+        .unwrap_or(if status.success() { 0 } else { 1 }))
+}
+
+/// Returns the -run value of the first `go test` command line in `text`, or
+/// else the run pattern of the patterns on its lines, anchors optional and
+/// anything after a tab ignored.
+fn clipboard_run_pattern(text: &str, anchor: bool) -> Result<String> {
+    if let Some(line) = text.lines().find(|line| line.contains("go test ")) {
+        let words = skim_args::split(line)?;
+        let run = words.iter().enumerate().find_map(|(index, word)| {
+            let name = word.trim_start_matches('-');
+            match name.split_once('=') {
+                Some(("run" | "test.run", value)) => Some(value.to_string()),
+                None if word.starts_with('-') && matches!(name, "run" | "test.run") => {
+                    words.get(index + 1).cloned()
+                }
+                _ => None,
+            }
+        });
+        return match run {
+            Some(run) => Ok(run),
+            None => anyhow::bail!("the go test command on the clipboard has no -run pattern"),
+        };
+    }
+
+    let names: Vec<String> = text
+        .lines()
+        .map(|line| line.split('\t').next().unwrap_or("").trim())
+        .filter(|line| !line.is_empty())
+        .map(|line| {
+            let line = line.strip_prefix('^').unwrap_or(line);
+            line.strip_suffix('$').unwrap_or(line).to_string()
+        })
+        .collect();
+    if names.is_empty() {
+        anyhow::bail!("the clipboard is empty");
+    }
+
+    Ok(build_run_pattern(&names, anchor))
+}
+
+/// Runs the tests that failed in the last run from this directory. Only the
+/// innermost failures are run, since a failed subtest fails its parents too;
+/// failures not found among the discovered patterns, like subtests with
+/// computed names, run the closest discovered parent.
+fn rerun_failed(tests: &[TestInfo], options: &RunOptions) -> Result<()> {
+    let failures = Failures::load().current();
+
+    if failures.is_empty() {
+        println!("No failed tests in the last run");
+        return Ok(());
+    }
+
+    let mut import_paths = HashMap::new();
+    let mut selected_tests: Vec<String> = Vec::new();
+
+    for (package, failed) in &failures {
+        let innermost = failed.iter().filter(|name| {
+            !failed.iter().any(|other| {
+                other
+                    .strip_prefix(name.as_str())
+                    .is_some_and(|rest| rest.starts_with('/'))
+            })
+        });
+
+        for name in innermost {
+            let closest = tests
+                .iter()
+                .filter(|test| {
+                    import_paths
+                        .entry(test.package.clone())
+                        .or_insert_with(|| gomod::import_path(Path::new(&test.package)))
+                        .as_deref()
+                        == Some(package.as_str())
+                })
+                .flat_map(|test| collect_test_patterns(std::slice::from_ref(test)))
+                .filter(|pattern| {
+                    let go_name = go_test_name(pattern);
+                    name == &go_name
+                        || name
+                            .strip_prefix(go_name.as_str())
+                            .is_some_and(|rest| rest.starts_with('/'))
+                })
+                .max_by_key(|pattern| pattern.len());
+
+            match closest {
+                Some(pattern) if !selected_tests.contains(&pattern) => selected_tests.push(pattern),
+                Some(_) => {}
+                None => eprintln!(
+                    "note: failed test {} in {} is no longer found",
+                    name, package
+                ),
+            }
+        }
+    }
+
+    if selected_tests.is_empty() {
+        println!("No failed tests found");
+        return Ok(());
+    }
+
+    println!("Rerunning {} failed test(s)", selected_tests.len());
+    let code = run_selection(tests, &selected_tests, options)?;
+
+    if code != 0 {
+        std::process::exit(code);
+    }
+
+    Ok(())
+}
+
+/// Returns the patterns to run for the changed line ranges of `test`'s file:
+/// the innermost changed subtests, or the test itself when a change inside it
+/// is not within any subtest (setup code, or subtests that could not be found).
+fn changed_patterns(
+    test: &TestInfo,
+    changed: &HashMap<PathBuf, Vec<(usize, usize)>>,
+) -> Vec<String> {
+    let Some(ranges) = changed.get(&affected::canonical(Path::new(&test.file))) else {
+        return Vec::new();
+    };
+
+    let touches =
+        |start: usize, end: usize| ranges.iter().any(|&(from, to)| from <= end && start <= to);
+    let in_subtest = |line: usize| {
+        test.subtests
+            .iter()
+            .any(|subtest| subtest.line <= line && line <= subtest.end_line)
+    };
+
+    let outside_subtests = ranges.iter().any(|&(from, to)| {
+        (from.max(test.line)..=to.min(test.end_line)).any(|line| !in_subtest(line))
+    });
+    if outside_subtests {
+        return vec![test.name.clone()];
+    }
+
+    let touched: Vec<&Subtest> = test
+        .subtests
+        .iter()
+        .filter(|subtest| touches(subtest.line, subtest.end_line))
+        .collect();
+
+    touched
+        .iter()
+        .filter(|subtest| {
+            let nested = format!("{}/", subtest.name);
+            !touched.iter().any(|other| other.name.starts_with(&nested))
+        })
+        .map(|subtest| format!("{}/{}", test.name, subtest.name))
+        .collect()
+}
+
+fn run_watch(args: &Args, options: &DiscoveryOptions, run_options: &RunOptions) -> Result<()> {
+    let (cache_key, mut cache) = load_cache(&args.directories(), options);
+    let mut tests = discover(&args.directories(), args, options, &mut cache)?;
+    save_cache(cache_key.as_deref(), &cache);
+    let mut test_patterns = candidate_patterns(&tests, run_options);
+
+    if test_patterns.is_empty() {
+        println!("No tests found");
+        return Ok(());
+    }
+
+    let mut selected_tests = skim_select(&test_patterns, &tests, run_options)?;
+    let mut snapshot = source_snapshot(&args.directories());
+
+    loop {
+        if selected_tests.is_empty() {
+            println!("No tests selected");
+            return Ok(());
+        }
+
+        run_selection(&tests, &selected_tests, run_options)?;
+
+        println!("Watching {} for changes...", args.directories().join(", "));
+        snapshot = wait_for_changes(&args.directories(), snapshot);
+
+        tests = discover(&args.directories(), args, options, &mut cache)?;
+        save_cache(cache_key.as_deref(), &cache);
+        println!("rediscovered {} tests", tests.len());
+
+        // Reopen the selector only when new tests showed up, otherwise keep
+        // rerunning the current selection.
+        let rediscovered = candidate_patterns(&tests, run_options);
+        if rediscovered
+            .iter()
+            .any(|pattern| !test_patterns.contains(pattern))
+        {
+            selected_tests = skim_select(&rediscovered, &tests, run_options)?;
+        }
+        test_patterns = rediscovered;
+    }
+}
+
+/// Returns the modification times of the Go files under the directory
+/// arguments, each overlapping root walked once.
+fn source_snapshot(dirs: &[&str]) -> HashMap<PathBuf, SystemTime> {
+    glob::distinct_roots(dirs)
+        .unwrap_or_default()
+        .iter()
+        .flat_map(WalkDir::new)
+        .filter_map(|entry| entry.ok())
+        .filter(|entry| entry.path().extension().is_some_and(|ext| ext == "go"))
+        .filter_map(|entry| {
+            let modified = entry.metadata().ok()?.modified().ok()?;
+            Some((entry.into_path(), modified))
+        })
+        .collect()
+}
+
+fn wait_for_changes(
+    dirs: &[&str],
+    snapshot: HashMap<PathBuf, SystemTime>,
+) -> HashMap<PathBuf, SystemTime> {
+    loop {
+        thread::sleep(WATCH_INTERVAL);
+
+        let mut current = source_snapshot(dirs);
+        if current == snapshot {
+            continue;
+        }
+
+        // Wait for the tree to settle so a burst of writes triggers one run.
+        loop {
+            thread::sleep(WATCH_DEBOUNCE);
+
+            let next = source_snapshot(dirs);
+            if next == current {
+                return next;
+            }
+            current = next;
+        }
+    }
+}
+
+/// Returns the patterns to offer in skim, ordered by recorded duration when
+/// --sort is set. Patterns without history keep their order after the rest.
+fn candidate_patterns(tests: &[TestInfo], options: &RunOptions) -> Vec<String> {
+    let patterns_of = |test: &TestInfo| {
+        let mut patterns = collect_test_patterns(std::slice::from_ref(test));
+        if options.only_subtests && !test.subtests.is_empty() {
+            patterns.retain(|pattern| pattern != &test.name);
+        }
+        patterns
+    };
+
+    let Some(order) = options.sort else {
+        return tests.iter().flat_map(patterns_of).collect();
+    };
+
+    if let SortOrder::Largest = order {
+        // Subtests have no size of their own and stay with their test.
+        let mut sized: Vec<(&TestInfo, Vec<String>)> =
+            tests.iter().map(|test| (test, patterns_of(test))).collect();
+        sized.sort_by_key(|(test, _)| std::cmp::Reverse(test.size));
+        return sized
+            .into_iter()
+            .flat_map(|(_, patterns)| patterns)
+            .collect();
+    }
+
+    let history = History::load();
+    let mut import_paths = HashMap::new();
+    let mut patterns = Vec::new();
+
+    for test in tests {
+        let import_path = import_paths
+            .entry(test.package.clone())
+            .or_insert_with(|| gomod::import_path(Path::new(&test.package)));
+
+        for pattern in patterns_of(test) {
+            // go test reports subtest names with spaces replaced by underscores.
+            let duration = import_path
+                .as_deref()
+                .and_then(|package| history.duration(package, &pattern.replace(' ', "_")));
+            patterns.push((pattern, duration));
+        }
+    }
+
+    patterns.sort_by(|(_, a), (_, b)| match (a, b) {
+        (Some(a), Some(b)) => match order {
+            SortOrder::Slowest => b.total_cmp(a),
+            SortOrder::Fastest => a.total_cmp(b),
+            SortOrder::Largest => unreachable!("sorted by size above"),
+        },
+        (Some(_), None) => Ordering::Less,
+        (None, Some(_)) => Ordering::Greater,
+        (None, None) => Ordering::Equal,
+    });
+
+    patterns.into_iter().map(|(pattern, _)| pattern).collect()
+}
+
+fn collect_test_patterns(tests: &[TestInfo]) -> Vec<String> {
+    let mut patterns = Vec::new();
+
+    for test in tests {
+        if test.subtests.is_empty() {
+            patterns.push(test.name.clone());
+        } else {
+            patterns.push(test.name.clone());
+            for subtest in &test.subtests {
+                patterns.push(format!("{}/{}", test.name, subtest.name));
+            }
+        }
+    }
+
+    patterns
+}
+
+/// Returns the file and line each pattern is declared at: the `t.Run` call
+/// for subtests, the function for tests. Table-driven subtests also have
+/// their case data.
+fn pattern_locations(tests: &[TestInfo]) -> HashMap<String, (&str, usize, Option<&str>)> {
+    let mut locations = HashMap::new();
+
+    for test in tests {
+        locations.insert(test.name.clone(), (test.file.as_str(), test.line, None));
+        for subtest in &test.subtests {
+            locations.insert(
+                format!("{}/{}", test.name, subtest.name),
+                (test.file.as_str(), subtest.line, subtest.case.as_deref()),
+            );
+        }
+    }
+
+    locations
+}
+
+/// Returns the --prompt or --header text with its placeholders filled in,
+/// or `default` when it was not given.
+fn label(text: Option<&str>, default: &str, count: usize, options: &RunOptions) -> String {
+    match text {
+        Some(text) => text
+            .replace("{count}", &count.to_string())
+            .replace("{tags}", options.tags.default_tags().unwrap_or("")),
+        None => default.to_string(),
+    }
+}
+
+fn skim_select(
+    patterns: &[String],
+    tests: &[TestInfo],
+    options: &RunOptions,
+) -> Result<Vec<String>> {
+    // Items are "pattern\tfile\tline\tscroll\tcase"; only the pattern is
+    // shown and matched, the rest feeds the preview. The case data is printed
+    // above the file, so the preview scrolls that many lines further.
+    let locations = pattern_locations(tests);
+    let options_str = patterns
+        .iter()
+        .map(|pattern| {
+            let (file, line, case) = locations.get(pattern).copied().unwrap_or(("", 0, None));
+            let case = case.unwrap_or("").replace('\t', "    ");
+            let scroll = match case.lines().count() {
+                0 => line.max(1),
+                lines => line.max(1) + lines + 1,
+            };
+            format!(
+                "{}\t{}\t{}\t{}\t{}",
+                pattern,
+                file,
+                line.max(1),
+                scroll,
+                case.replace('\n', "\x1f")
+            )
+        })
+        .collect::<Vec<_>>()
+        .join("\n");
+    let item_reader = SkimItemReader::default();
+    let items = item_reader.of_bufread(Cursor::new(options_str));
+
+    let mut builder = SkimOptionsBuilder::default();
+    builder
+        .height("50%".to_string())
+        .color(Some("light".to_string()))
+        .multi(true)
+        .prompt(label(
+            options.prompt.as_deref(),
+            "Select tests (TAB to multi-select): ",
+            patterns.len(),
+            options,
+        ))
+        .header(Some(label(
+            options.header.as_deref(),
+            "Press TAB to select multiple tests, ENTER to confirm",
+            patterns.len(),
+            options,
+        )))
+        .query(options.query.clone())
+        .delimiter("\t".to_string())
+        .with_nth(vec!["1".to_string()])
+        .nth(vec!["1".to_string()])
+        .preview(Some(PREVIEW_COMMAND.to_string()))
+        .preview_window("right:50%:+{4}-/2".to_string());
+    skim_args::apply(&mut builder, &options.fzf_args)?;
+
+    let skim_options = builder
+        .build()
+        .map_err(|e| anyhow::anyhow!("Failed to build skim options: {}", e))?;
+
+    let result = Skim::run_with(&skim_options, Some(items));
+
+    if io::stdout().is_terminal() {
+        print!("\x1b[2J\x1b[H");
+        io::stdout().flush().unwrap();
+    }
+
+    if let Some(output) = result {
+        if output.is_abort {
+            return Ok(vec![]);
+        }
+
+        Ok(output
+            .selected_items
+            .iter()
+            .map(|item| {
+                let output = item.output();
+                output.split('\t').next().unwrap_or(&output).to_string()
+            })
+            .collect())
+    } else {
+        Ok(vec![])
+    }
+}
+
+/// Joins the selected patterns into a -run value. With `anchor`, every
+/// slash-separated element is escaped and wrapped in `^...$`, since go test
+/// matches each level of a subtest name separately, and the patterns are
+/// grouped by parent: selected siblings share one element, as in
+/// `^TestA$/^(?:x|y)$`, and patterns below a selected test are dropped since
+/// it runs them anyway.
+fn build_run_pattern(selected_tests: &[String], anchor: bool) -> String {
+    if !anchor {
+        return selected_tests.join("|");
+    }
+
+    let mut tree = RunTree::default();
+    for pattern in selected_tests {
+        tree.insert(pattern.split('/'));
+    }
+
+    tree.alternatives("").join("|")
+}
+
+/// Selected patterns by name element, in selection order.
+#[derive(Default)]
+struct RunTree {
+    selected: bool,
+    children: Vec<(String, RunTree)>,
+}
+
+impl RunTree {
+    fn insert<'a>(&mut self, mut elements: impl Iterator<Item = &'a str>) {
+        if self.selected {
+            return;
+        }
+
+        let Some(element) = elements.next() else {
+            self.selected = true;
+            self.children.clear();
+            return;
+        };
+
+        let index = match self.children.iter().position(|(name, _)| name == element) {
+            Some(index) => index,
+            None => {
+                self.children
+                    .push((element.to_string(), RunTree::default()));
+                self.children.len() - 1
+            }
+        };
+        self.children[index].1.insert(elements);
+    }
+
+    /// Returns one alternative per group of selected siblings below this
+    /// node, each starting with `prefix`.
+    fn alternatives(&self, prefix: &str) -> Vec<String> {
+        let mut selected = Vec::new();
+        let mut nested = Vec::new();
+
+        for (name, child) in &self.children {
+            let name = regex::escape(name);
+            if child.selected {
+                selected.push(name);
+            } else {
+                nested.extend(child.alternatives(&format!("{}^{}$/", prefix, name)));
+            }
+        }
+
+        let group = match selected.len() {
+            0 => None,
+            1 => Some(format!("{}^{}$", prefix, selected[0])),
+            _ => Some(format!("{}^(?:{})$", prefix, selected.join("|"))),
+        };
+
+        group.into_iter().chain(nested).collect()
+    }
+}
+
+/// Prints to stderr, for --explain, the tests and subtests `pattern` (a
+/// listed `Name` or `Name/subtest`) comes from and how it was turned into
+/// `emitted`: the names go test compares against, and any anchoring or
+/// escaping.
+fn explain_pattern(pattern: &str, emitted: &str, tests: &[TestInfo]) {
+    eprintln!("{}", emitted);
+
+    let (name, subtest) = match pattern.split_once('/') {
+        Some((name, subtest)) => (name, Some(subtest)),
+        None => (pattern, None),
+    };
+    for test in tests.iter().filter(|test| test.name == name) {
+        eprintln!(
+            "    {} {} at {}:{}",
+            test.kind.as_str(),
+            test.name,
+            test.file,
+            test.line
+        );
+
+        let Some(subtest) = subtest else {
+            continue;
+        };
+        let declared: Vec<&Subtest> = test
+            .subtests
+            .iter()
+            .filter(|other| other.name == subtest)
+            .collect();
+        for (index, declared) in declared.iter().enumerate() {
+            let suffix = if index > 0 {
+                format!(", run as {}#{:02}", go_test_name(subtest), index)
+            } else {
+                String::new()
+            };
+            eprintln!(
+                "    subtest {:?} at line {}{}",
+                subtest, declared.line, suffix
+            );
+        }
+    }
+
+    let go_name = go_test_name(pattern);
+    if go_name != pattern {
+        eprintln!(
+            "    go test names it {}: whitespace becomes _ and unprintable characters are escaped, in -run patterns too",
+            go_name
+        );
+    }
+
+    if emitted.contains('^') {
+        eprintln!("    anchored with ^ and $ so that names merely containing it don't match");
+    }
+    if pattern
+        .split('/')
+        .any(|element| regex::escape(element) != element)
+    {
+        if emitted.contains('\\') {
+            eprintln!("    regex metacharacters in the name escaped with \\");
+        } else {
+            eprintln!(
+                "    regex metacharacters in the name are not escaped here and act as regex syntax"
+            );
+        }
+    }
+}
+
+/// Returns the name go test reports for a test or subtest name as written in
+/// t.Run, like testing's rewrite: whitespace becomes `_` and unprintable
+/// characters are replaced by their Go escapes.
+fn go_test_name(name: &str) -> String {
+    let mut rewritten = String::new();
+
+    for c in name.chars() {
+        if c.is_whitespace() {
+            rewritten.push('_');
+        } else if c.is_control() {
+            rewritten.extend(c.escape_default());
+        } else {
+            rewritten.push(c);
+        }
+    }
+
+    rewritten
+}
+
+/// Replaces subtest patterns by their top-level test, keeping the order of
+/// first selection.
+fn parent_patterns(selected_tests: &[String]) -> Vec<String> {
+    let mut parents: Vec<String> = Vec::new();
+
+    for pattern in selected_tests {
+        let parent = pattern.split('/').next().unwrap_or(pattern);
+        if !parents.iter().any(|other| other == parent) {
+            parents.push(parent.to_string());
+        }
+    }
+
+    parents
+}
+
+/// Validates and runs the selected tests with one go test invocation per
+/// distinct set of build tags, returning the first non-zero exit code.
+fn run_selection(
+    tests: &[TestInfo],
+    selected_tests: &[String],
+    options: &RunOptions,
+) -> Result<i32> {
+    let parents;
+    let selected_tests = if options.expand_to_parent {
+        parents = parent_patterns(selected_tests);
+        &parents
+    } else {
+        selected_tests
+    };
+
+    if let Some(size) = options.batch_size
+        && selected_tests.len() > size
+    {
+        // A selected test runs its subtests anyway, so they should not take
+        // up room in another batch and run twice.
+        let selected_tests: Vec<String> = selected_tests
+            .iter()
+            .filter(|pattern| {
+                !selected_tests.iter().any(|other| {
+                    pattern
+                        .strip_prefix(other.as_str())
+                        .is_some_and(|rest| rest.starts_with('/'))
+                })
+            })
+            .cloned()
+            .collect();
+        let batches = selected_tests.len().div_ceil(size);
+        let mut code = 0;
+        let mut failed = Vec::new();
+
+        for (index, batch) in selected_tests.chunks(size).enumerate() {
+            if !failed.is_empty() && !options.keep_going {
+                note_stopped("batch", batches - index);
+                break;
+            }
+
+            let message = format!(
+                "Batch {}/{}: {} pattern(s)",
+                index + 1,
+                batches,
+                batch.len()
+            );
+            if options.json_run {
+                eprintln!("{}", message);
+            } else {
+                println!("{}", message);
+            }
+
+            let batch_code = match run_selection(tests, batch, options) {
+                Ok(batch_code) => batch_code,
+                Err(err) if options.keep_going => {
+                    eprintln!("error: {}", err);
+                    1
+                }
+                Err(err) => return Err(err),
+            };
+            if batch_code != 0 {
+                failed.push(format!("batch {}", index + 1));
+                if code == 0 {
+                    code = batch_code;
+                }
+            }
+        }
+
+        report_failures("batch", &failed, options);
+        return Ok(code);
+    }
+
+    let length = build_run_pattern(selected_tests, options.anchor).len();
+    if length > MAX_RUN_PATTERN {
+        if selected_tests.len() == 1 {
+            anyhow::bail!(
+                "the -run pattern of {} is {} bytes, too long to pass to go test",
+                selected_tests[0],
+                length
+            );
+        }
+        // Twice as many batches as the length needs, since patterns differ
+        // in length.
+        let size = selected_tests
+            .len()
+            .div_ceil(2 * length.div_ceil(MAX_RUN_PATTERN))
+            .max(1);
+        eprintln!(
+            "note: the -run pattern of {} selected tests is {} bytes, more than go test can be passed; running in batches of {} (choose with --batch-size)",
+            selected_tests.len(),
+            length,
+            size
+        );
+        let options = RunOptions {
+            batch_size: Some(size),
+            ..options.clone()
+        };
+        return run_selection(tests, selected_tests, &options);
+    }
+
+    if options.explain {
+        for pattern in selected_tests {
+            let element = build_run_pattern(std::slice::from_ref(pattern), options.anchor);
+            explain_pattern(pattern, &element, tests);
+        }
+        if selected_tests.len() > 1 {
+            eprintln!("-run {}", build_run_pattern(selected_tests, options.anchor));
+            eprintln!(
+                "    the patterns above joined with |, selected siblings grouped and patterns below a selected test dropped"
+            );
+        }
+    }
+
+    if options.package_seed.is_some() || options.topo_order || options.parallel_packages.is_some() {
+        let mut packages: BTreeMap<&str, Vec<&TestInfo>> = BTreeMap::new();
+        for test in tests {
+            if !selected_patterns(test, selected_tests).is_empty() {
+                packages.entry(&test.package).or_default().push(test);
+            }
+        }
+
+        let mut packages: Vec<(&str, Vec<&TestInfo>)> = packages.into_iter().collect();
+        if let Some(seed) = options.package_seed {
+            shuffle(&mut packages, seed);
+
+            let order: Vec<&str> = packages.iter().map(|(package, _)| *package).collect();
+            let message = format!("Package order (seed {}): {}", seed, order.join(" "));
+            if options.json_run {
+                eprintln!("{}", message);
+            } else {
+                println!("{}", message);
+            }
+        }
+        if options.topo_order {
+            let dirs: Vec<&str> = packages.iter().map(|(package, _)| *package).collect();
+            let message = match golist::dependency_order(&dirs, options.tags.default_tags()) {
+                Ok(order) => {
+                    packages
+                        .sort_by_key(|(package, _)| order.iter().position(|dir| dir == package));
+                    format!("Package order (dependencies first): {}", order.join(" "))
+                }
+                Err(err) => format!(
+                    "warning: could not get the import graph, running packages in alphabetical order: {}",
+                    err
+                ),
+            };
+            if options.json_run {
+                eprintln!("{}", message);
+            } else {
+                println!("{}", message);
+            }
+        }
+
+        let groups = packages
+            .into_iter()
+            .map(|(package, group)| (options.tags.for_path(Path::new(package)), group))
+            .collect();
+        return match options.parallel_packages {
+            Some(jobs) => run_parallel(groups, selected_tests, jobs, options),
+            None => run_groups(groups, selected_tests, options),
+        };
+    }
+
+    let mut groups: BTreeMap<Option<&str>, Vec<&TestInfo>> = BTreeMap::new();
+    for test in tests {
+        if !selected_patterns(test, selected_tests).is_empty() {
+            groups
+                .entry(options.tags.for_path(Path::new(&test.file)))
+                .or_default()
+                .push(test);
+        }
+    }
+
+    if groups.len() <= 1 {
+        let tags = groups
+            .keys()
+            .next()
+            .copied()
+            .unwrap_or(options.tags.default_tags());
+
+        if options.validate && !validate_packages(&selected_packages(tests, selected_tests), tags)?
+        {
+            return Ok(1);
+        }
+
+        let packages = if options.tidy {
+            selected_packages(tests, selected_tests)
+        } else {
+            Vec::new()
+        };
+        let status = execute_go_test(
+            &build_run_pattern(selected_tests, options.anchor),
+            &packages,
+            tags,
+            options,
+        )?;
+
+        return Ok(status
+            .code()
+            .unwrap_or(if status.success() { 0 } else { 1 }));
+    }
+
+    // Each group only runs its own packages, since other directories may not
+    // build with its tags.
+    run_groups(groups.into_iter().collect(), selected_tests, options)
+}
+
+/// Runs each group's selected tests with one go test limited to the group's
+/// packages, in order, returning the first non-zero exit code. The groups
+/// after a failed one are only run with --keep-going.
+fn run_groups(
+    groups: Vec<(Option<&str>, Vec<&TestInfo>)>,
+    selected_tests: &[String],
+    options: &RunOptions,
+) -> Result<i32> {
+    let mut code = 0;
+    let mut failed = Vec::new();
+    let count = groups.len();
+
+    for (index, (tags, group)) in groups.into_iter().enumerate() {
+        if !failed.is_empty() && !options.keep_going {
+            note_stopped("package", count - index);
+            break;
+        }
+        let (patterns, packages) = group_selection(&group, selected_tests);
+
+        let result = if options.validate && !validate_packages(&packages, tags)? {
+            Ok(1)
+        } else {
+            execute_go_test(
+                &build_run_pattern(&patterns, options.anchor),
+                &packages,
+                tags,
+                options,
+            )
+            .map(|status| {
+                status
+                    .code()
+                    .unwrap_or(if status.success() { 0 } else { 1 })
+            })
+        };
+
+        let group_code = match result {
+            Ok(group_code) => group_code,
+            Err(err) if options.keep_going => {
+                eprintln!("error: could not run go test: {}", err);
+                1
+            }
+            Err(err) => return Err(err),
+        };
+        if group_code != 0 {
+            failed.push(packages.join(" "));
+            if code == 0 {
+                code = group_code;
+            }
+        }
+    }
+
+    report_failures("package", &failed, options);
+    Ok(code)
+}
+
+/// Tells, without --keep-going, that the `remaining` packages or batches are
+/// not run because one failed.
+fn note_stopped(what: &str, remaining: usize) {
+    eprintln!(
+        "note: {} {}(s) not run after the failure, run them anyway with --keep-going",
+        remaining, what
+    );
+}
+
+/// Lists, with --keep-going, the separately run packages or batches that
+/// failed, once all of them ran.
+fn report_failures(what: &str, failed: &[String], options: &RunOptions) {
+    if !options.keep_going || failed.is_empty() {
+        return;
+    }
+
+    let message = format!(
+        "FAIL: {} {}(s) failed:\n{}",
+        failed.len(),
+        what,
+        failed
+            .iter()
+            .map(|failure| format!("    {}", failure))
+            .collect::<Vec<_>>()
+            .join("\n")
+    );
+    if options.json_run {
+        eprintln!("{}", message);
+    } else {
+        println!("{}", message);
+    }
+}
+
+/// Returns the selected patterns of a group's tests and their packages.
+fn group_selection(group: &[&TestInfo], selected_tests: &[String]) -> (Vec<String>, Vec<String>) {
+    let mut patterns = Vec::new();
+    let mut packages = BTreeSet::new();
+
+    for test in group {
+        for pattern in selected_patterns(test, selected_tests) {
+            if !patterns.contains(&pattern) {
+                patterns.push(pattern);
+            }
+        }
+        packages.insert(test.package.clone());
+    }
+
+    (patterns, packages.into_iter().collect())
+}
+
+/// Runs the groups' go tests with up to `jobs` at a time. Each one's output
+/// is buffered and printed as a block once it finishes, so that packages
+/// don't interleave. Returns the first non-zero exit code in group order.
+fn run_parallel(
+    groups: Vec<(Option<&str>, Vec<&TestInfo>)>,
+    selected_tests: &[String],
+    jobs: usize,
+    options: &RunOptions,
+) -> Result<i32> {
+    let queue = Mutex::new(groups.into_iter().enumerate());
+    let finished = Mutex::new(Vec::new());
+    let printing = Mutex::new(());
+
+    thread::scope(|scope| {
+        for _ in 0..jobs {
+            scope.spawn(|| {
+                loop {
+                    let Some((index, (tags, group))) = queue.lock().unwrap().next() else {
+                        break;
+                    };
+                    let (code, results) =
+                        match run_buffered(&group, tags, selected_tests, options, &printing) {
+                            Ok(outcome) => outcome,
+                            Err(err) => {
+                                eprintln!("error: could not run go test: {}", err);
+                                (1, Vec::new())
+                            }
+                        };
+                    let packages = group_selection(&group, selected_tests).1.join(" ");
+                    finished
+                        .lock()
+                        .unwrap()
+                        .push((index, code, results, packages));
+
+                    // Running packages finish, but no more are started.
+                    if code != 0 && !options.keep_going {
+                        let remaining = queue.lock().unwrap().by_ref().count();
+                        if remaining > 0 {
+                            note_stopped("package", remaining);
+                        }
+                    }
+                }
+            });
+        }
+    });
+
+    let mut finished = finished.into_inner().unwrap();
+    finished.sort_by_key(|(index, _, _, _)| *index);
+
+    let results: Vec<gotest::TestEvent> = finished
+        .iter_mut()
+        .flat_map(|(_, _, results, _)| std::mem::take(results))
+        .collect();
+    if options.summary_only {
+        gotest::print_summary(&results);
+    }
+    if let Err(err) = History::record(&results) {
+        eprintln!("warning: could not save test history: {}", err);
+    }
+    if let Err(err) = Failures::record(&results) {
+        eprintln!("warning: could not save the failed tests: {}", err);
+    }
+
+    let failed: Vec<String> = finished
+        .iter()
+        .filter(|(_, code, _, _)| *code != 0)
+        .map(|(_, _, _, packages)| packages.clone())
+        .collect();
+    report_failures("package", &failed, options);
+
+    Ok(finished
+        .iter()
+        .map(|(_, code, _, _)| *code)
+        .find(|&code| code != 0)
+        .unwrap_or(0))
+}
+
+/// Runs the go test of one group of --parallel-packages with its output
+/// captured, then prints it while holding `printing`. Returns the exit code
+/// and the test results.
+fn run_buffered(
+    group: &[&TestInfo],
+    tags: Option<&str>,
+    selected_tests: &[String],
+    options: &RunOptions,
+    printing: &Mutex<()>,
+) -> Result<(i32, Vec<gotest::TestEvent>)> {
+    let (patterns, packages) = group_selection(group, selected_tests);
+    let cmd = go_test_command(
+        &build_run_pattern(&patterns, options.anchor),
+        &packages,
+        tags,
+        options,
+    );
+    let output = wrap_command(json_command(&cmd, options), &options.wrapper).output()?;
+
+    let _printing = printing.lock().unwrap();
+    print_running(&cmd, options);
+    io::stderr().write_all(&output.stderr)?;
+    let results = gotest::render_json(
+        output.stdout.as_slice(),
+        options.verbose,
+        options.json_run,
+        options.summary_only,
+    )?;
+    io::stdout().flush()?;
+
+    let code = output
+        .status
+        .code()
+        .unwrap_or(if output.status.success() { 0 } else { 1 });
+    Ok((code, results))
+}
+
+/// Shuffles `items` in place with a Fisher-Yates shuffle driven by a
+/// xorshift generator, so that the same seed gives the same order.
+fn shuffle<T>(items: &mut [T], seed: i64) {
+    let mut state = (seed as u64) | 1;
+
+    for i in (1..items.len()).rev() {
+        state ^= state << 13;
+        state ^= state >> 7;
+        state ^= state << 17;
+        items.swap(i, (state % (i as u64 + 1)) as usize);
+    }
+}
+
+/// Returns the patterns of `test` and its subtests that were selected.
+fn selected_patterns(test: &TestInfo, selected_tests: &[String]) -> Vec<String> {
+    collect_test_patterns(std::slice::from_ref(test))
+        .into_iter()
+        .filter(|pattern| selected_tests.contains(pattern))
+        .collect()
+}
+
+fn selected_packages(tests: &[TestInfo], selected_tests: &[String]) -> Vec<String> {
+    let mut packages = BTreeSet::new();
+
+    for test in tests {
+        if !selected_patterns(test, selected_tests).is_empty() {
+            packages.insert(test.package.clone());
+        }
+    }
+
+    packages.into_iter().collect()
+}
+
+/// Runs go vet, which also compiles the test files, on the given packages and
+/// reports whether they built cleanly.
+fn validate_packages(packages: &[String], tags: Option<&str>) -> Result<bool> {
+    let mut cmd = Command::new("go");
+    cmd.arg("vet");
+
+    if let Some(tags_value) = tags {
+        cmd.arg(format!("-tags={}", tags_value));
+    }
+
+    cmd.args(packages);
+
+    println!("Validating {} package(s)...", packages.len());
+
+    let output = cmd.output()?;
+
+    if !output.status.success() {
+        eprintln!("Build errors, not running tests:");
+        eprint!("{}", String::from_utf8_lossy(&output.stderr));
+        return Ok(false);
+    }
+
+    Ok(true)
+}
+
+fn go_test_command(
+    run_pattern: &str,
+    packages: &[String],
+    tags: Option<&str>,
+    options: &RunOptions,
+) -> Command {
+    let mut cmd = Command::new("go");
+    cmd.arg("test");
+    // -C has to come first.
+    if let Some(dir) = &options.chdir {
+        cmd.arg("-C").arg(dir);
+    }
+    match (options.bench_count, options.stress) {
+        (Some(count), _) => cmd.args([format!("-count={}", count), "-benchmem".to_string()]),
+        (None, Some(count)) => cmd.args([
+            format!("-count={}", count),
+            "-race".to_string(),
+            format!("-parallel={}", count),
+        ]),
+        (None, None) => cmd.arg("-count=1"),
+    };
+    cmd.envs(options.env.iter().map(|(key, value)| (key, value)));
+
+    if options.verbose {
+        cmd.arg("-v");
+    }
+
+    if options.json_run {
+        cmd.arg("-json");
+    }
+
+    if let Some(tags_value) = tags {
+        cmd.arg(format!("-tags={}", tags_value));
+    }
+
+    // Always pass an explicit seed so the running line records it.
+    if let Some(seed) = options.shuffle_seed {
+        cmd.arg(format!("-shuffle={}", seed));
+    }
+
+    if options.bench_count.is_some() {
+        // Skip the tests, only run the selected benchmarks.
+        cmd.args(["-run", "^$", "-bench", run_pattern]);
+    } else if !run_pattern.is_empty() {
+        cmd.arg("-run").arg(run_pattern);
+        if options.include_bench {
+            // Selected benchmarks only run with -bench; tests do not match it.
+            cmd.arg("-bench").arg(run_pattern);
+        }
+    }
+
+    // Test binary arguments must follow the packages.
+    let split = options
+        .go_args
+        .iter()
+        .position(|arg| arg == "-args")
+        .unwrap_or(options.go_args.len());
+    cmd.args(&options.go_args[..split]);
+
+    if packages.is_empty() {
+        cmd.arg("./...");
+    } else {
+        cmd.args(packages.iter().map(|package| {
+            if gomod::in_module_cache(Path::new(package)) {
+                gomod::import_path(Path::new(package)).unwrap_or(package.clone())
+            } else if options.chdir.is_some() {
+                // Package directories are relative to where discovery ran.
+                affected::canonical(Path::new(package))
+                    .to_string_lossy()
+                    .to_string()
+            } else {
+                package.clone()
+            }
+        }));
+    }
+
+    cmd.args(&options.go_args[split..]);
+
+    cmd
+}
+
+/// Runs go test through `go test -json`, rendering its usual output and
+/// recording the test durations in the history.
+fn execute_go_test(
+    run_pattern: &str,
+    packages: &[String],
+    tags: Option<&str>,
+    options: &RunOptions,
+) -> Result<ExitStatus> {
+    let cmd = go_test_command(run_pattern, packages, tags, options);
+    print_running(&cmd, options);
+
+    if options.bench_count.is_some() {
+        return bench::run(
+            wrap_command(cmd, &options.wrapper),
+            options.benchstat.as_deref(),
+            options.save_baseline.as_deref(),
+        );
+    }
+
+    let cmd = wrap_command(json_command(&cmd, options), &options.wrapper);
+    let outcome = match &options.pipe {
+        Some(pipe) => gotest::pipe_json(cmd, pipe, options.json_run)?,
+        None => gotest::run_json(cmd, options.verbose, options.json_run, options.summary_only)?,
+    };
+
+    if options.summary_only {
+        gotest::print_summary(&outcome.results);
+    }
+
+    if let Err(err) = History::record(&outcome.results) {
+        eprintln!("warning: could not save test history: {}", err);
+    }
+    if let Err(err) = Failures::record(&outcome.results) {
+        eprintln!("warning: could not save the failed tests: {}", err);
+    }
+
+    Ok(outcome.status)
+}
+
+/// Prompts for changes to the flags of the last run and reruns the same
+/// selection with them, until `q` or the end of input. The changes go after
+/// `--` like the user's own go test arguments, where they win over the
+/// defaults. Returns the exit code of the last run.
+fn repl(
+    tests: &[TestInfo],
+    selected_tests: &[String],
+    options: &RunOptions,
+    mut code: i32,
+) -> Result<i32> {
+    let mut options = options.clone();
+    let mut race = options.stress.is_some() || go_flag(&options.go_args, "race").is_some();
+    let mut count = go_flag(&options.go_args, "count")
+        .and_then(|value| value.parse().ok())
+        .or(options.stress)
+        .unwrap_or(1);
+
+    loop {
+        eprintln!();
+        eprintln!(
+            "Last run {} ({}-count={}{}). Enter or r: rerun, v: toggle -v, race: toggle -race, count N, q: quit",
+            if code == 0 { "passed" } else { "failed" },
+            if options.verbose { "-v " } else { "" },
+            count,
+            if race { " -race" } else { "" }
+        );
+        eprint!("> ");
+        io::stderr().flush()?;
+
+        let mut line = String::new();
+        if io::stdin().read_line(&mut line)? == 0 {
+            break;
+        }
+        let words: Vec<&str> = line.split_whitespace().collect();
+
+        match words.as_slice() {
+            [] | ["r"] => {}
+            ["q"] | ["quit"] => break,
+            ["v"] => {
+                options.verbose = !options.verbose;
+                continue;
+            }
+            ["race"] => {
+                race = !race;
+                set_go_flag(&mut options.go_args, "race", &race.to_string());
+                continue;
+            }
+            ["count", n] => match n.parse::<usize>() {
+                Ok(n) if n > 0 => {
+                    count = n;
+                    set_go_flag(&mut options.go_args, "count", &n.to_string());
+                    continue;
+                }
+                _ => {
+                    eprintln!("count needs a positive number");
+                    continue;
+                }
+            },
+            _ => {
+                eprintln!("unknown command: {}", line.trim());
+                continue;
+            }
+        }
+
+        code = run_selection(tests, selected_tests, &options)?;
+    }
+
+    Ok(code)
+}
+
+/// Returns the value of the go test flag `name` in `go_args`, `""` when it
+/// has none, or `None` when it is not there.
+fn go_flag<'a>(go_args: &'a [String], name: &str) -> Option<&'a str> {
+    let split = go_args
+        .iter()
+        .position(|arg| arg == "-args")
+        .unwrap_or(go_args.len());
+    go_args[..split].iter().rev().find_map(|arg| {
+        let (flag, value) = arg.split_once('=').unwrap_or((arg, ""));
+        (flag.trim_start_matches('-') == name && arg.starts_with('-')).then_some(value)
+    })
+}
+
+/// Replaces the go test flag `name` in `go_args` with `-name=value`, before
+/// `-args`.
+fn set_go_flag(go_args: &mut Vec<String>, name: &str, value: &str) {
+    let split = go_args
+        .iter()
+        .position(|arg| arg == "-args")
+        .unwrap_or(go_args.len());
+    let mut flags: Vec<String> = go_args
+        .drain(..split)
+        .filter(|arg| {
+            !(arg.starts_with('-')
+                && arg.split('=').next().unwrap_or("").trim_start_matches('-') == name)
+        })
+        .collect();
+    flags.push(format!("-{}={}", name, value));
+    go_args.splice(0..0, flags);
+}
+
+/// Prints the `Running:` line of a go test command, on stderr when stdout is
+/// reserved for its JSON output.
+fn print_running(cmd: &Command, options: &RunOptions) {
+    let running = format!(
+        "Running: {}{}go {}",
+        options
+            .env
+            .iter()
+            .map(|(key, value)| format!("{}={} ", key, value))
+            .collect::<String>(),
+        options
+            .wrapper
+            .iter()
+            .map(|arg| format!("{} ", arg))
+            .collect::<String>(),
+        cmd.get_args()
+            .map(|arg| arg.to_string_lossy())
+            .collect::<Vec<_>>()
+            .join(" ")
+    );
+
+    // Keep stdout pure JSON when passing it through.
+    if options.json_run {
+        eprintln!("{}", running);
+    } else {
+        println!("{}", running);
+    }
+}
+
+/// Returns `cmd` with -json, which go test output is rendered from.
+fn json_command(cmd: &Command, options: &RunOptions) -> Command {
+    let mut json_cmd = Command::new(cmd.get_program());
+    let mut args = cmd.get_args().skip(1).peekable();
+    json_cmd.arg("test");
+    if args.peek().is_some_and(|arg| *arg == "-C") {
+        json_cmd.args(args.by_ref().take(2));
+    }
+    if !options.json_run {
+        json_cmd.arg("-json");
+    }
+    json_cmd.args(args);
+    json_cmd.envs(options.env.iter().map(|(key, value)| (key, value)));
+    json_cmd
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Discovery options for linux/amd64 without cgo, finding every kind of
+    /// test with their subtests.
+    fn options() -> DiscoveryOptions {
+        DiscoveryOptions {
+            warn: false,
+            build: BuildContext {
+                goos: "linux".to_string(),
+                goarch: "amd64".to_string(),
+                tags: TagRules::default(),
+                cgo: Some(false),
+            },
+            exclude: Vec::new(),
+            dir_exclude: Vec::new(),
+            scan_subtests: true,
+            profile: None,
+            progress: false,
+            prefixes: vec!["Test".to_string()],
+            kinds: vec![Kind::Test, Kind::Benchmark, Kind::Fuzz, Kind::Example],
+            subtest_patterns: SubtestPatterns::new().unwrap(),
+            recurse: true,
+            suffix: "_test.go".to_string(),
+            any_platform: false,
+        }
+    }
+
+    fn names(tests: &[TestInfo]) -> Vec<&str> {
+        tests.iter().map(|test| test.name.as_str()).collect()
+    }
+
+    /// The path of a fixture under testdata.
+    fn fixture(path: &str) -> String {
+        format!("{}/testdata/{}", env!("CARGO_MANIFEST_DIR"), path)
+    }
+
+    #[test]
+    fn generic_functions_are_not_tests() {
+        let content = "package x
+
+import \"testing\"
+
+func TestPlain(t *testing.T) {}
+
+func TestGeneric[T any](t *testing.T) {}
+
+func TestConstrained[T ~int | ~string, U comparable](t *testing.T) {}
+
+func TestWrongParam(b *testing.B) {}
+
+func Testlower(t *testing.T) {}
+
+func BenchmarkPlain(b *testing.B) {}
+
+func BenchmarkGeneric[T any](b *testing.B) {}
+
+func FuzzGeneric[T any](f *testing.F) {}
+
+func ExampleGeneric[T any]() {}
+";
+        let tests = parse_test_file(Path::new("x_test.go"), content, &options()).unwrap();
+        assert_eq!(names(&tests), ["TestPlain", "BenchmarkPlain"]);
+
+        assert!(is_test_function(
+            "TestX",
+            "Test",
+            false,
+            "t *testing.T",
+            Kind::Test
+        ));
+        assert!(!is_test_function(
+            "TestX",
+            "Test",
+            true,
+            "t *testing.T",
+            Kind::Test
+        ));
+        assert!(!is_test_function(
+            "TestX",
+            "Test",
+            false,
+            "b *testing.B",
+            Kind::Test
+        ));
+        assert!(is_test_function(
+            "BenchmarkX",
+            "Benchmark",
+            false,
+            "b *testing.B",
+            Kind::Benchmark
+        ));
+        assert!(is_test_function(
+            "ExampleX",
+            "Example",
+            false,
+            "",
+            Kind::Example
+        ));
+        assert!(!is_test_function(
+            "ExampleX",
+            "Example",
+            true,
+            "",
+            Kind::Example
+        ));
+    }
+
+    #[test]
+    fn discovery_is_deterministic() {
+        let root = fixture("discovery");
+        let options = options();
+        let discover = |cache: &mut ParseCache| {
+            let tests = find_tests(&[&root], &options, cache).unwrap();
+            serde_json::to_string(&tests).unwrap()
+        };
+
+        let mut cache = ParseCache::default();
+        let cold = discover(&mut cache);
+        let warm = discover(&mut cache);
+        let again = discover(&mut ParseCache::default());
+        let mut reloaded: ParseCache =
+            serde_json::from_str(&serde_json::to_string(&cache).unwrap()).unwrap();
+        let saved = discover(&mut reloaded);
+
+        assert_eq!(cold, warm);
+        assert_eq!(cold, again);
+        assert_eq!(cold, saved);
+
+        // Sorted by file and line, whatever order the files were read in.
+        let tests: Vec<TestInfo> = serde_json::from_str(&cold).unwrap();
+        let found: Vec<String> = tests
+            .iter()
+            .map(|test| {
+                let file = Path::new(&test.file).strip_prefix(&root).unwrap();
+                format!("{} {}", file.display(), test.name)
+            })
+            .collect();
+        assert_eq!(
+            found,
+            [
+                "alpha/alpha_test.go TestSecond",
+                "alpha/alpha_test.go TestFirst",
+                "alpha/alpha_test.go ExampleFirst",
+                "mid/nested/nested_test.go FuzzNested",
+                "mid/nested/nested_test.go TestNested",
+                "zeta/a_test.go BenchmarkZeta",
+                "zeta/zeta_test.go TestZulu",
+                "zeta/zeta_test.go TestAlpha",
+            ]
+        );
+        let subtests = |test: &TestInfo| -> Vec<String> {
+            test.subtests
+                .iter()
+                .map(|subtest| subtest.name.clone())
+                .collect()
+        };
+        assert_eq!(subtests(&tests[1]), ["z", "y"]);
+        assert_eq!(subtests(&tests[6]), ["b", "a"]);
+    }
+
+    /// Reports whether go test -run `pattern` runs the test or subtest
+    /// `name`, splitting the pattern like testing's splitRegexp: at `|` and
+    /// `/` outside brackets and parentheses, with `\` escaping the next byte.
+    fn go_runs(pattern: &str, name: &str) -> bool {
+        let mut alternatives = vec![Vec::new()];
+        let (mut brackets, mut parens, mut start) = (0, 0, 0);
+        let bytes = pattern.as_bytes();
+        let mut i = 0;
+        while i < bytes.len() {
+            match bytes[i] {
+                b'[' => brackets += 1,
+                b']' => brackets = (brackets - 1).max(0),
+                b'(' if brackets == 0 => parens += 1,
+                b')' if brackets == 0 => parens -= 1,
+                b'\\' => i += 1,
+                separator @ (b'/' | b'|') if brackets == 0 && parens == 0 => {
+                    alternatives.last_mut().unwrap().push(&pattern[start..i]);
+                    if separator == b'|' {
+                        alternatives.push(Vec::new());
+                    }
+                    start = i + 1;
+                }
+                _ => {}
+            }
+            i += 1;
+        }
+        alternatives.last_mut().unwrap().push(&pattern[start..]);
+
+        alternatives.iter().any(|levels| {
+            name.split('/')
+                .zip(levels)
+                .all(|(element, level)| Regex::new(level).unwrap().is_match(element))
+        })
+    }
+
+    #[test]
+    fn run_patterns() {
+        struct Case {
+            selected: &'static [&'static str],
+            anchor: bool,
+            pattern: &'static str,
+            runs: &'static [&'static str],
+            skips: &'static [&'static str],
+        }
+
+        let cases = [
+            // Selected siblings share one element.
+            Case {
+                selected: &["TestA/x", "TestA/y"],
+                anchor: true,
+                pattern: "^TestA$/^(?:x|y)$",
+                runs: &["TestA/x", "TestA/y"],
+                skips: &["TestA/z", "TestA/xy", "TestAB/x"],
+            },
+            // Several parents are joined by a top-level |.
+            Case {
+                selected: &["TestA", "TestB/grp/z", "TestC/x"],
+                anchor: true,
+                pattern: "^TestA$|^TestB$/^grp$/^z$|^TestC$/^x$",
+                runs: &["TestA", "TestA/any", "TestB/grp/z", "TestC/x"],
+                skips: &["TestB/grp/w", "TestB/other/z", "TestC/y", "TestD"],
+            },
+            // A selected parent runs its selected descendants anyway.
+            Case {
+                selected: &["TestA/x", "TestA", "TestA/y/z"],
+                anchor: true,
+                pattern: "^TestA$",
+                runs: &["TestA", "TestA/x", "TestA/w", "TestA/y/z"],
+                skips: &["TestAB"],
+            },
+            // Regex metacharacters in names are escaped, including | which
+            // would otherwise split the pattern.
+            Case {
+                selected: &["TestA/a.b", "TestA/(x)", "TestA/a|b"],
+                anchor: true,
+                pattern: r"^TestA$/^(?:a\.b|\(x\)|a\|b)$",
+                runs: &["TestA/a.b", "TestA/(x)", "TestA/a|b"],
+                skips: &["TestA/axb", "TestA/x", "TestA/a", "TestA/b"],
+            },
+            // Without anchors, names match anything containing them.
+            Case {
+                selected: &["TestA", "TestB/x"],
+                anchor: false,
+                pattern: "TestA|TestB/x",
+                runs: &["TestA", "TestAB", "TestB/x", "TestB/xy", "TestB/x/deep"],
+                skips: &["TestC", "TestB/y"],
+            },
+            // Selection order is kept within each group.
+            Case {
+                selected: &["TestC/y", "TestB", "TestC/x", "TestA"],
+                anchor: true,
+                pattern: "^(?:TestB|TestA)$|^TestC$/^(?:y|x)$",
+                runs: &["TestA", "TestB", "TestC/x", "TestC/y"],
+                skips: &["TestC/z"],
+            },
+        ];
+
+        for case in cases {
+            let selected: Vec<String> = case.selected.iter().map(|s| s.to_string()).collect();
+            let pattern = build_run_pattern(&selected, case.anchor);
+
+            assert_eq!(pattern, case.pattern, "selected {:?}", case.selected);
+            for name in case.runs {
+                assert!(go_runs(&pattern, name), "{} should run {}", pattern, name);
+            }
+            for name in case.skips {
+                assert!(!go_runs(&pattern, name), "{} should skip {}", pattern, name);
+            }
+        }
+    }
+
+    #[test]
+    fn go_quote_matches_strconv_quote() {
+        let quoted: Vec<String> = [
+            "plain name",
+            "say \"hi\"",
+            "C:\\dir",
+            "two\nlines\tand\rreturn",
+            "bell\u{7} del\u{7f}",
+            "next\u{85}line\u{2028}sep",
+            "café ✓",
+        ]
+        .iter()
+        .map(|text| go_quote(text))
+        .collect();
+
+        // As printed by strconv.Quote.
+        assert_eq!(
+            quoted,
+            [
+                r#""plain name""#,
+                r#""say \"hi\"""#,
+                r#""C:\\dir""#,
+                r#""two\nlines\tand\rreturn""#,
+                r#""bell\a del\x7f""#,
+                r#""next\u0085line\u2028sep""#,
+                r#""café ✓""#,
+            ]
+        );
+    }
+
+    #[test]
+    fn any_platform_reads_files_of_other_platforms() {
+        let root = fixture("discovery/alpha");
+        let names = |options: &DiscoveryOptions| -> Vec<String> {
+            find_tests(&[&root], options, &mut ParseCache::default())
+                .unwrap()
+                .into_iter()
+                .map(|test| test.name)
+                .collect()
+        };
+
+        assert!(!names(&options()).contains(&"TestWindowsOnly".to_string()));
+
+        let options = DiscoveryOptions {
+            any_platform: true,
+            ..options()
+        };
+        assert!(names(&options).contains(&"TestWindowsOnly".to_string()));
+    }
+
+    #[test]
+    fn subtests_named_at_helper_call_sites() {
+        let path = fixture("subtests/helpers_test.go");
+        let content = std::fs::read_to_string(&path).unwrap();
+        let tests = parse_test_file(Path::new(&path), &content, &options()).unwrap();
+
+        let found: Vec<(&str, Vec<&str>)> = tests
+            .iter()
+            .map(|test| {
+                let subtests = test.subtests.iter().map(|subtest| subtest.name.as_str());
+                (test.name.as_str(), subtests.collect())
+            })
+            .collect();
+        assert_eq!(
+            found,
+            [
+                ("TestLiterals", vec!["empty", "one"]),
+                (
+                    "TestNestedHelper",
+                    vec!["through two helpers", "parent", "parent/below parent"]
+                ),
+                ("TestFixedInHelper", vec!["group", "group/labelled"]),
+                // Names computed from variables are not resolved.
+                ("TestComputedName", vec![]),
+            ]
+        );
+
+        // A subtest named at a call site is located at the call.
+        let literals = &tests[0].subtests;
+        assert_eq!(
+            content.lines().nth(literals[0].line - 1).unwrap().trim(),
+            r#"check(t, "empty", 0)"#
+        );
+        assert_eq!(
+            content.lines().nth(literals[1].line - 1).unwrap().trim(),
+            r#"check(t, "one", 1)"#
+        );
+    }
+
+    /// A test with every field set, so that nothing is left out when
+    /// serialized.
+    fn populated_test(case: Option<String>) -> TestInfo {
+        TestInfo {
+            name: "TestParse".to_string(),
+            file: "./parser/parse_test.go".to_string(),
+            line: 10,
+            end_line: 20,
+            package: "./parser".to_string(),
+            external: true,
+            kind: Kind::Test,
+            doc_tags: vec!["slow".to_string()],
+            skipped: true,
+            focused: true,
+            generated: true,
+            documented: true,
+            helper: true,
+            size: 120,
+            fixtures: vec!["testdata/in.json".to_string()],
+            owners: vec!["@parsers".to_string()],
+            subtests: vec![Subtest {
+                name: "empty".to_string(),
+                line: 12,
+                end_line: 14,
+                case,
+            }],
+        }
+    }
+
+    /// The keys of a JSON object, sorted.
+    fn keys(value: &serde_json::Value) -> BTreeSet<&str> {
+        value
+            .as_object()
+            .expect("an object")
+            .keys()
+            .map(String::as_str)
+            .collect()
+    }
+
+    /// The names listed in a schema's `required` array.
+    fn required(schema: &serde_json::Value) -> Vec<&str> {
+        schema["required"]
+            .as_array()
+            .expect("a required array")
+            .iter()
+            .map(|name| name.as_str().unwrap())
+            .collect()
+    }
+
+    #[test]
+    fn schema_matches_serialization() {
+        let schema = test_schema();
+        let subtest_schema = &schema["$defs"]["subtest"];
+
+        for case in [Some("{in: 1}".to_string()), None] {
+            let test = serde_json::to_value(populated_test(case)).unwrap();
+            let subtest = &test["subtests"][0];
+
+            assert_eq!(keys(&test), keys(&schema["properties"]));
+            assert_eq!(keys(subtest), keys(&subtest_schema["properties"]));
+
+            for name in required(&schema) {
+                assert!(
+                    test.get(name).is_some(),
+                    "{} is required but not emitted",
+                    name
+                );
+            }
+            for name in required(subtest_schema) {
+                assert!(
+                    subtest.get(name).is_some(),
+                    "subtest {} is required but not emitted",
+                    name
+                );
+            }
+        }
+
+        // Required names must be properties too.
+        assert!(
+            required(&schema)
+                .iter()
+                .all(|name| keys(&schema["properties"]).contains(name))
+        );
+        assert!(
+            required(subtest_schema)
+                .iter()
+                .all(|name| keys(&subtest_schema["properties"]).contains(name))
+        );
+    }
+
+    #[test]
+    fn table_test_cases() {
+        let path = fixture("subtests/table_test.go");
+        let content = std::fs::read_to_string(&path).unwrap();
+        let tests = parse_test_file(Path::new(&path), &content, &options()).unwrap();
+
+        // Each subtest as "Test/name line: case".
+        let found: Vec<String> = tests
+            .iter()
+            .flat_map(|test| {
+                test.subtests.iter().map(|subtest| {
+                    format!(
+                        "{}/{} {}: {}",
+                        test.name,
+                        subtest.name,
+                        subtest.line,
+                        subtest.case.as_deref().unwrap_or("-")
+                    )
+                })
+            })
+            .collect();
+
+        assert_eq!(
+            found,
+            [
+                r#"TestInlineKeyed/empty 22: {name: "empty", in: "", want: 0}"#,
+                "TestInlineKeyed/with, comma 23: {\n\tname: \"with, comma\",\n\tin:   \"a,b\", // two\n\twant: 2,\n}",
+                r#"TestInlinePositional/zero 43: {"zero", 0, 0}"#,
+                r#"TestInlinePositional/double {braces} 44: {"double {braces}", f(1, 2), 2}"#,
+                r#"TestNamedType/keyed 52: {name: "keyed", in: "a b", want: []string{"a", "b"}}"#,
+                r#"TestNamedType/positional 53: {"positional", "a", nil, struct{ sep string }{" "}}"#,
+                "TestMapCases/first 63: {in: 1, want: 1}",
+            ]
+        );
+    }
+
+    #[test]
+    fn struct_field_names() {
+        assert_eq!(
+            struct_fields(
+                "\n\tname, in string\n\twant []string // parts\n\t*pkg.Base\n\tMixin[int]\n\topts struct {\n\t\tsep string\n\t}\n\ttag string `json:\"tag\"`\n"
+            ),
+            ["name", "in", "want", "Base", "Mixin", "opts", "tag"]
+        );
+        assert_eq!(struct_fields(" a int; b, c string "), ["a", "b", "c"]);
+    }
+}
@@ -0,0 +1,106 @@
+use anyhow::{Context, Result, bail};
+use regex::Regex;
+use std::path::{Path, PathBuf};
+
+use crate::affected::canonical;
+
+/// A list of directories to search, each with its own build tags and
+/// excluded tests, read from lines like `./integration tags=db exclude=TestSlow.*`.
+pub struct Manifest {
+    pub entries: Vec<Entry>,
+}
+
+pub struct Entry {
+    /// The directory, relative to the manifest's directory unless absolute.
+    pub dir: String,
+    pub tags: Option<String>,
+    /// Fully matching patterns of tests and subtests to leave out.
+    pub exclude: Vec<Regex>,
+}
+
+impl Manifest {
+    /// Reads a manifest. Blank lines and `#` comments are skipped; errors
+    /// name the file and line.
+    pub fn load(path: &str) -> Result<Self> {
+        let content =
+            std::fs::read_to_string(path).with_context(|| format!("cannot read {}", path))?;
+        let base = Path::new(path).parent().unwrap_or(Path::new(""));
+
+        let entries = content
+            .lines()
+            .enumerate()
+            .filter_map(|(index, line)| {
+                let line = line.split_once('#').map_or(line, |(entry, _)| entry).trim();
+                (!line.is_empty()).then(|| {
+                    parse_entry(line, base)
+                        .with_context(|| format!("{}:{}: invalid entry", path, index + 1))
+                })
+            })
+            .collect::<Result<_>>()?;
+
+        Ok(Manifest { entries })
+    }
+
+    /// The directories of the entries, for searching.
+    pub fn dirs(&self) -> impl Iterator<Item = &str> {
+        self.entries.iter().map(|entry| entry.dir.as_str())
+    }
+
+    /// The `DIR=TAGS` values of the entries with tags, as for --tags.
+    pub fn tag_rules(&self) -> impl Iterator<Item = String> {
+        self.entries.iter().filter_map(|entry| {
+            entry
+                .tags
+                .as_ref()
+                .map(|tags| format!("{}={}", entry.dir, tags))
+        })
+    }
+
+    /// The exclude patterns of the entries, each with the resolved directory
+    /// it applies under.
+    pub fn dir_excludes(&self) -> Vec<(PathBuf, Regex)> {
+        self.entries
+            .iter()
+            .flat_map(|entry| {
+                let dir = canonical(Path::new(&entry.dir));
+                entry
+                    .exclude
+                    .iter()
+                    .map(move |regex| (dir.clone(), regex.clone()))
+            })
+            .collect()
+    }
+}
+
+fn parse_entry(line: &str, base: &Path) -> Result<Entry> {
+    let mut fields = line.split_whitespace();
+    let dir = fields.next().expect("the line is not empty");
+
+    let dir: PathBuf = base.join(dir);
+    if !dir.is_dir() {
+        bail!("{} is not a directory", dir.display());
+    }
+
+    let mut entry = Entry {
+        dir: dir.to_string_lossy().to_string(),
+        tags: None,
+        exclude: Vec::new(),
+    };
+
+    for field in fields {
+        match field.split_once('=') {
+            Some(("tags", tags)) if entry.tags.is_none() => entry.tags = Some(tags.to_string()),
+            Some(("tags", _)) => bail!("tags given twice"),
+            Some(("exclude", pattern)) => entry.exclude.push(
+                Regex::new(&format!("^(?:{})$", pattern))
+                    .with_context(|| format!("invalid exclude regex {:?}", pattern))?,
+            ),
+            _ => bail!(
+                "unknown setting {:?}, expected tags=... or exclude=...",
+                field
+            ),
+        }
+    }
+
+    Ok(entry)
+}
@@ -0,0 +1,725 @@
+use anyhow::{Result, bail};
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use std::sync::OnceLock;
+
+use crate::affected::canonical;
+
+const KNOWN_OS: &[&str] = &[
+    "aix",
+    "android",
+    "darwin",
+    "dragonfly",
+    "freebsd",
+    "hurd",
+    "illumos",
+    "ios",
+    "js",
+    "linux",
+    "nacl",
+    "netbsd",
+    "openbsd",
+    "plan9",
+    "solaris",
+    "wasip1",
+    "windows",
+    "zos",
+];
+
+const KNOWN_ARCH: &[&str] = &[
+    "386",
+    "amd64",
+    "amd64p32",
+    "arm",
+    "armbe",
+    "arm64",
+    "arm64be",
+    "loong64",
+    "mips",
+    "mipsle",
+    "mips64",
+    "mips64le",
+    "mips64p32",
+    "mips64p32le",
+    "ppc",
+    "ppc64",
+    "ppc64le",
+    "riscv",
+    "riscv64",
+    "s390",
+    "s390x",
+    "sparc",
+    "sparc64",
+    "wasm",
+];
+
+const UNIX_OS: &[&str] = &[
+    "aix",
+    "android",
+    "darwin",
+    "dragonfly",
+    "freebsd",
+    "hurd",
+    "illumos",
+    "ios",
+    "linux",
+    "netbsd",
+    "openbsd",
+    "solaris",
+];
+
+/// The ports listed by `go tool dist list`.
+const PORTS: &[(&str, &str)] = &[
+    ("aix", "ppc64"),
+    ("android", "386"),
+    ("android", "amd64"),
+    ("android", "arm"),
+    ("android", "arm64"),
+    ("darwin", "amd64"),
+    ("darwin", "arm64"),
+    ("dragonfly", "amd64"),
+    ("freebsd", "386"),
+    ("freebsd", "amd64"),
+    ("freebsd", "arm"),
+    ("freebsd", "arm64"),
+    ("illumos", "amd64"),
+    ("ios", "amd64"),
+    ("ios", "arm64"),
+    ("js", "wasm"),
+    ("linux", "386"),
+    ("linux", "amd64"),
+    ("linux", "arm"),
+    ("linux", "arm64"),
+    ("linux", "loong64"),
+    ("linux", "mips"),
+    ("linux", "mips64"),
+    ("linux", "mips64le"),
+    ("linux", "mipsle"),
+    ("linux", "ppc64"),
+    ("linux", "ppc64le"),
+    ("linux", "riscv64"),
+    ("linux", "s390x"),
+    ("netbsd", "386"),
+    ("netbsd", "amd64"),
+    ("netbsd", "arm"),
+    ("netbsd", "arm64"),
+    ("openbsd", "386"),
+    ("openbsd", "amd64"),
+    ("openbsd", "arm"),
+    ("openbsd", "arm64"),
+    ("openbsd", "ppc64"),
+    ("openbsd", "riscv64"),
+    ("plan9", "386"),
+    ("plan9", "amd64"),
+    ("plan9", "arm"),
+    ("solaris", "amd64"),
+    ("wasip1", "wasm"),
+    ("windows", "386"),
+    ("windows", "amd64"),
+    ("windows", "arm64"),
+];
+
+/// Build tags given with --tags: plain values apply everywhere, `dir=tags`
+/// values apply to files under that directory instead.
+#[derive(Debug, Clone, Default)]
+pub struct TagRules {
+    default: Option<String>,
+    dirs: Vec<(PathBuf, String)>,
+}
+
+impl TagRules {
+    pub fn parse(values: &[String]) -> Result<Self> {
+        let mut rules = TagRules::default();
+
+        for value in values {
+            match value.split_once('=') {
+                Some((dir, tags)) => {
+                    if dir.is_empty() {
+                        bail!(
+                            "invalid --tags value {:?}: missing directory before '='",
+                            value
+                        );
+                    }
+                    rules
+                        .dirs
+                        .push((canonical(Path::new(dir)), tags.to_string()));
+                }
+                None => rules.default = Some(value.clone()),
+            }
+        }
+
+        // Most specific directory first.
+        rules
+            .dirs
+            .sort_by_key(|(dir, _)| std::cmp::Reverse(dir.components().count()));
+
+        Ok(rules)
+    }
+
+    /// The tags that apply outside of any `dir=tags` directory.
+    pub fn default_tags(&self) -> Option<&str> {
+        self.default.as_deref()
+    }
+
+    /// The tags that apply to a file or package directory.
+    pub fn for_path(&self, path: &Path) -> Option<&str> {
+        if self.dirs.is_empty() {
+            return self.default_tags();
+        }
+
+        let path = canonical(path);
+        self.dirs
+            .iter()
+            .find(|(dir, _)| path.starts_with(dir))
+            .map(|(_, tags)| tags.as_str())
+            .or(self.default_tags())
+    }
+}
+
+/// The target platform and tags used to decide which files `go test` would build.
+#[derive(Debug, Clone)]
+pub struct BuildContext {
+    pub goos: String,
+    pub goarch: String,
+    pub tags: TagRules,
+    /// Whether cgo is enabled, when set by a flag or `$CGO_ENABLED`; otherwise
+    /// the go tool's default applies.
+    pub cgo: Option<bool>,
+}
+
+impl BuildContext {
+    /// Builds a context for the given platform, falling back to `$GOOS`/`$GOARCH`
+    /// and then to the host platform. cgo likewise falls back to `$CGO_ENABLED`.
+    pub fn new(
+        goos: Option<String>,
+        goarch: Option<String>,
+        cgo: Option<bool>,
+        tags: TagRules,
+    ) -> Self {
+        let goos = goos
+            .or_else(|| std::env::var("GOOS").ok().filter(|v| !v.is_empty()))
+            .unwrap_or_else(host_goos);
+        let goarch = goarch
+            .or_else(|| std::env::var("GOARCH").ok().filter(|v| !v.is_empty()))
+            .unwrap_or_else(host_goarch);
+        let cgo = cgo.or_else(|| {
+            std::env::var("CGO_ENABLED")
+                .ok()
+                .and_then(|value| cgo_setting(&value))
+        });
+        BuildContext {
+            goos,
+            goarch,
+            tags,
+            cgo,
+        }
+    }
+
+    /// Reports whether a file would be built, applying the go tool's
+    /// `_GOOS`, `_GOARCH` and `_GOOS_GOARCH` file name suffix rules.
+    pub fn matches_file_name(&self, path: &Path) -> bool {
+        let file_name = path
+            .file_name()
+            .map(|name| name.to_string_lossy())
+            .unwrap_or_default();
+        let tags = self.tags.for_path(path);
+        let name = file_name.split('.').next().unwrap_or(&file_name);
+
+        // Everything before the first underscore is ignored, so `linux_test.go`
+        // is not platform specific.
+        let Some(index) = name.find('_') else {
+            return true;
+        };
+
+        let mut parts: Vec<&str> = name[index..].split('_').collect();
+        if parts.last() == Some(&"test") {
+            parts.pop();
+        }
+
+        let n = parts.len();
+        if n >= 2 && KNOWN_OS.contains(&parts[n - 2]) && KNOWN_ARCH.contains(&parts[n - 1]) {
+            return self.matches_tag(parts[n - 1], tags) && self.matches_tag(parts[n - 2], tags);
+        }
+        if n >= 1 && (KNOWN_OS.contains(&parts[n - 1]) || KNOWN_ARCH.contains(&parts[n - 1])) {
+            return self.matches_tag(parts[n - 1], tags);
+        }
+
+        true
+    }
+
+    /// Reports whether the `//go:build` constraint in the file header, if any,
+    /// is satisfied. Malformed constraints are treated as satisfied so that
+    /// `go test` gets to report them.
+    pub fn matches_constraints(&self, path: &Path, content: &str) -> bool {
+        match build_constraint(content) {
+            Some(expr) => match parse_constraint(expr) {
+                Some(constraint) => {
+                    let tags = self.tags.for_path(path);
+                    constraint.eval(&|tag| self.matches_tag(tag, tags))
+                }
+                None => true,
+            },
+            None => true,
+        }
+    }
+
+    fn matches_tag(&self, tag: &str, tags: Option<&str>) -> bool {
+        tag == self.goos
+            || tag == self.goarch
+            || (tag == "linux" && self.goos == "android")
+            || (tag == "solaris" && self.goos == "illumos")
+            || (tag == "darwin" && self.goos == "ios")
+            || (tag == "unix" && UNIX_OS.contains(&self.goos.as_str()))
+            || tag == "gc"
+            || (tag == "cgo" && self.cgo_enabled())
+            || tag.strip_prefix("go1.").is_some_and(release_tag_satisfied)
+            || tags.is_some_and(|tags| tags.split([',', ' ']).any(|t| t == tag))
+    }
+
+    /// Reports whether cgo is enabled. Unless set, the go tool disables it
+    /// when cross-compiling and otherwise enables it if a C compiler is
+    /// found, which `go env` reports.
+    fn cgo_enabled(&self) -> bool {
+        static GO_CGO: OnceLock<bool> = OnceLock::new();
+
+        self.cgo.unwrap_or_else(|| {
+            self.goos == host_goos()
+                && self.goarch == host_goarch()
+                && *GO_CGO.get_or_init(|| {
+                    Command::new("go")
+                        .args(["env", "CGO_ENABLED"])
+                        .output()
+                        .is_ok_and(|output| output.stdout.trim_ascii() == b"1")
+                })
+        })
+    }
+}
+
+/// Interprets a `$CGO_ENABLED` value the way the go tool does: `1` and `0`
+/// set it, anything else leaves the default.
+fn cgo_setting(value: &str) -> Option<bool> {
+    match value {
+        "1" => Some(true),
+        "0" => Some(false),
+        _ => None,
+    }
+}
+
+/// Returns the `goos/goarch` ports on which a file would be built, going by
+/// its name and `//go:build` constraint.
+pub fn building_ports(path: &Path, content: &str, tags: &TagRules) -> Vec<String> {
+    PORTS
+        .iter()
+        .filter(|(goos, goarch)| {
+            let build = BuildContext {
+                goos: goos.to_string(),
+                goarch: goarch.to_string(),
+                tags: tags.clone(),
+                cgo: None,
+            };
+            build.matches_file_name(path) && build.matches_constraints(path, content)
+        })
+        .map(|(goos, goarch)| format!("{}/{}", goos, goarch))
+        .collect()
+}
+
+/// The number of ports `building_ports` considers.
+pub fn port_count() -> usize {
+    PORTS.len()
+}
+
+/// Reports whether the release tag `go1.<minor>` is set by the installed go,
+/// which sets the tags of its own and all earlier releases. Unknown versions
+/// satisfy every release tag.
+fn release_tag_satisfied(minor: &str) -> bool {
+    static GO_MINOR: OnceLock<Option<u32>> = OnceLock::new();
+
+    let installed = GO_MINOR.get_or_init(|| {
+        let output = Command::new("go")
+            .args(["env", "GOVERSION"])
+            .output()
+            .ok()?;
+        go_minor(&String::from_utf8_lossy(&output.stdout))
+    });
+
+    match (minor.parse::<u32>(), installed) {
+        (Ok(minor), Some(installed)) => minor <= *installed,
+        (Ok(_), None) => true,
+        (Err(_), _) => false,
+    }
+}
+
+/// Extracts the minor version from a go version like `go1.22.5` or
+/// `devel go1.23-abcdef`.
+fn go_minor(version: &str) -> Option<u32> {
+    let rest = &version[version.find("go1.")? + "go1.".len()..];
+    let digits: String = rest.chars().take_while(|c| c.is_ascii_digit()).collect();
+    digits.parse().ok()
+}
+
+fn host_goos() -> String {
+    match std::env::consts::OS {
+        "macos" => "darwin".to_string(),
+        os => os.to_string(),
+    }
+}
+
+fn host_goarch() -> String {
+    match std::env::consts::ARCH {
+        "x86_64" => "amd64".to_string(),
+        "x86" => "386".to_string(),
+        "aarch64" => "arm64".to_string(),
+        "loongarch64" => "loong64".to_string(),
+        "powerpc64" if cfg!(target_endian = "little") => "ppc64le".to_string(),
+        "powerpc64" => "ppc64".to_string(),
+        arch => arch.to_string(),
+    }
+}
+
+/// Returns the expression of the `//go:build` line in the file header, which
+/// ends at the package clause.
+fn build_constraint(content: &str) -> Option<&str> {
+    let mut in_block_comment = false;
+
+    for line in content.lines() {
+        let line = line.trim();
+
+        if in_block_comment {
+            if line.contains("*/") {
+                in_block_comment = false;
+            }
+            continue;
+        }
+        if line.starts_with("/*") {
+            in_block_comment = !line.contains("*/");
+            continue;
+        }
+
+        if let Some(expr) = line.strip_prefix("//go:build") {
+            return Some(expr.trim());
+        }
+        if !line.is_empty() && !line.starts_with("//") {
+            return None;
+        }
+    }
+
+    None
+}
+
+#[derive(Debug)]
+enum Constraint {
+    Tag(String),
+    Not(Box<Constraint>),
+    And(Box<Constraint>, Box<Constraint>),
+    Or(Box<Constraint>, Box<Constraint>),
+}
+
+impl Constraint {
+    fn eval(&self, matches: &dyn Fn(&str) -> bool) -> bool {
+        match self {
+            Constraint::Tag(tag) => matches(tag),
+            Constraint::Not(inner) => !inner.eval(matches),
+            Constraint::And(left, right) => left.eval(matches) && right.eval(matches),
+            Constraint::Or(left, right) => left.eval(matches) || right.eval(matches),
+        }
+    }
+}
+
+fn parse_constraint(expr: &str) -> Option<Constraint> {
+    let tokens = tokenize(expr)?;
+    let mut pos = 0;
+    let constraint = parse_or(&tokens, &mut pos)?;
+
+    if pos == tokens.len() {
+        Some(constraint)
+    } else {
+        None
+    }
+}
+
+fn tokenize(expr: &str) -> Option<Vec<String>> {
+    let mut tokens = Vec::new();
+    let mut chars = expr.chars().peekable();
+
+    while let Some(&c) = chars.peek() {
+        match c {
+            ' ' | '\t' => {
+                chars.next();
+            }
+            '(' | ')' | '!' => {
+                tokens.push(c.to_string());
+                chars.next();
+            }
+            '&' | '|' => {
+                chars.next();
+                if chars.next() != Some(c) {
+                    return None;
+                }
+                tokens.push(format!("{}{}", c, c));
+            }
+            c if c.is_alphanumeric() || c == '_' || c == '.' => {
+                let mut tag = String::new();
+                while let Some(&c) = chars.peek() {
+                    if !(c.is_alphanumeric() || c == '_' || c == '.') {
+                        break;
+                    }
+                    tag.push(c);
+                    chars.next();
+                }
+                tokens.push(tag);
+            }
+            _ => return None,
+        }
+    }
+
+    Some(tokens)
+}
+
+fn parse_or(tokens: &[String], pos: &mut usize) -> Option<Constraint> {
+    let mut left = parse_and(tokens, pos)?;
+
+    while tokens.get(*pos).is_some_and(|t| t == "||") {
+        *pos += 1;
+        let right = parse_and(tokens, pos)?;
+        left = Constraint::Or(Box::new(left), Box::new(right));
+    }
+
+    Some(left)
+}
+
+fn parse_and(tokens: &[String], pos: &mut usize) -> Option<Constraint> {
+    let mut left = parse_not(tokens, pos)?;
+
+    while tokens.get(*pos).is_some_and(|t| t == "&&") {
+        *pos += 1;
+        let right = parse_not(tokens, pos)?;
+        left = Constraint::And(Box::new(left), Box::new(right));
+    }
+
+    Some(left)
+}
+
+fn parse_not(tokens: &[String], pos: &mut usize) -> Option<Constraint> {
+    let token = tokens.get(*pos)?;
+    *pos += 1;
+
+    match token.as_str() {
+        "!" => Some(Constraint::Not(Box::new(parse_not(tokens, pos)?))),
+        "(" => {
+            let inner = parse_or(tokens, pos)?;
+            if tokens.get(*pos).is_some_and(|t| t == ")") {
+                *pos += 1;
+                Some(inner)
+            } else {
+                None
+            }
+        }
+        ")" | "&&" | "||" => None,
+        tag => Some(Constraint::Tag(tag.to_string())),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn context(goos: &str, goarch: &str, cgo: Option<bool>) -> BuildContext {
+        BuildContext {
+            goos: goos.to_string(),
+            goarch: goarch.to_string(),
+            tags: TagRules::default(),
+            cgo,
+        }
+    }
+
+    fn builds(build: &BuildContext, constraint: &str) -> bool {
+        build.matches_constraints(
+            Path::new("x_test.go"),
+            &format!("//go:build {}\n\npackage x\n", constraint),
+        )
+    }
+
+    #[test]
+    fn constraint_operators() {
+        let cases: &[(&str, &[&str], bool)] = &[
+            ("a", &["a"], true),
+            ("a", &["b"], false),
+            ("!a", &["a"], false),
+            ("!a", &[], true),
+            ("!!a", &["a"], true),
+            ("a && b", &["a", "b"], true),
+            ("a && b", &["a"], false),
+            ("a || b", &["b"], true),
+            ("a || b", &[], false),
+            // && binds tighter than ||.
+            ("a || b && !c", &["a", "c"], true),
+            ("a || b && !c", &["b"], true),
+            ("a || b && !c", &["b", "c"], false),
+            ("a || b && !c", &[], false),
+            ("(a || b) && !c", &["a", "c"], false),
+            ("(a || b) && !c", &["a"], true),
+            ("!(a && b)", &["a", "b"], false),
+            ("!(a && b)", &["a"], true),
+            ("a&&(b||c)", &["a", "c"], true),
+            ("go1.21 && linux_amd64", &["go1.21", "linux_amd64"], true),
+        ];
+
+        for &(expr, set, want) in cases {
+            let constraint =
+                parse_constraint(expr).unwrap_or_else(|| panic!("{:?} did not parse", expr));
+            assert_eq!(
+                constraint.eval(&|tag| set.contains(&tag)),
+                want,
+                "{:?} with {:?}",
+                expr,
+                set
+            );
+        }
+    }
+
+    #[test]
+    fn malformed_constraints() {
+        for expr in [
+            "",
+            "a &&",
+            "&& a",
+            "a & b",
+            "a | b",
+            "a || || b",
+            "(a",
+            "a)",
+            "()",
+            "!",
+            "a b",
+            "a ! b",
+            "a-b",
+            "a,b",
+        ] {
+            assert!(parse_constraint(expr).is_none(), "{:?} parsed", expr);
+        }
+
+        // Left for go test to report rather than hiding the file.
+        assert!(builds(&context("linux", "amd64", None), "linux &&"));
+        assert!(builds(&context("windows", "amd64", None), "(linux"));
+    }
+
+    #[test]
+    fn platform_tags() {
+        let cases = [
+            ("linux", "amd64", "linux", true),
+            ("linux", "amd64", "amd64", true),
+            ("linux", "amd64", "windows", false),
+            ("linux", "amd64", "arm64", false),
+            ("linux", "amd64", "unix", true),
+            ("darwin", "arm64", "unix", true),
+            ("windows", "amd64", "unix", false),
+            ("plan9", "amd64", "unix", false),
+            ("js", "wasm", "unix", false),
+            ("ios", "arm64", "darwin", true),
+            ("ios", "arm64", "ios", true),
+            ("darwin", "arm64", "ios", false),
+            ("android", "arm64", "linux", true),
+            ("android", "arm64", "android", true),
+            ("linux", "arm64", "android", false),
+            ("illumos", "amd64", "solaris", true),
+            ("solaris", "amd64", "illumos", false),
+            ("linux", "amd64", "gc", true),
+            ("linux", "amd64", "gccgo", false),
+            ("windows", "amd64", "!unix && amd64", true),
+        ];
+
+        for (goos, goarch, constraint, want) in cases {
+            assert_eq!(
+                builds(&context(goos, goarch, None), constraint),
+                want,
+                "{:?} on {}/{}",
+                constraint,
+                goos,
+                goarch
+            );
+        }
+    }
+
+    #[test]
+    fn release_tags() {
+        let build = context("linux", "amd64", None);
+
+        // Every go that runs this has go1.1; a tag that is not a release is
+        // never set.
+        assert!(builds(&build, "go1.1"));
+        assert!(!builds(&build, "go1.x"));
+        assert!(!builds(&build, "go2"));
+
+        assert_eq!(go_minor("go1.22.5"), Some(22));
+        assert_eq!(go_minor("go1.23rc1"), Some(23));
+        assert_eq!(go_minor("devel go1.24-abcdef Tue"), Some(24));
+        assert_eq!(go_minor("go2.0"), None);
+    }
+
+    #[test]
+    fn cgo_tag() {
+        let (host_os, host_arch) = (host_goos(), host_goarch());
+        let cross_os = if host_os == "windows" {
+            "linux"
+        } else {
+            "windows"
+        };
+
+        // CGO_ENABLED=0 disables it, on the host or not.
+        assert_eq!(cgo_setting("0"), Some(false));
+        assert!(!builds(&context(&host_os, &host_arch, Some(false)), "cgo"));
+        assert!(builds(&context(&host_os, &host_arch, Some(false)), "!cgo"));
+
+        // Cross-compiling disables it unless it is set.
+        assert!(!builds(&context(cross_os, &host_arch, None), "cgo"));
+        assert!(!builds(&context(&host_os, "wasm", None), "cgo"));
+
+        // CGO_ENABLED=1 enables it, even when cross-compiling.
+        assert_eq!(cgo_setting("1"), Some(true));
+        assert!(builds(&context(&host_os, &host_arch, Some(true)), "cgo"));
+        assert!(builds(
+            &context(cross_os, &host_arch, Some(true)),
+            "cgo && !nocgo"
+        ));
+
+        // Other values leave the go tool's default.
+        assert_eq!(cgo_setting(""), None);
+        assert_eq!(cgo_setting("true"), None);
+    }
+
+    #[test]
+    fn file_name_suffixes() {
+        let cases = [
+            ("x_test.go", "linux", "amd64", true),
+            ("x_linux_test.go", "linux", "amd64", true),
+            ("x_linux_test.go", "windows", "amd64", false),
+            // Everything before the first underscore is ignored.
+            ("linux_test.go", "windows", "amd64", true),
+            ("linux.go", "windows", "amd64", true),
+            ("x_linux_amd64_test.go", "linux", "amd64", true),
+            ("x_linux_amd64_test.go", "linux", "arm64", false),
+            ("x_linux_amd64_test.go", "darwin", "amd64", false),
+            ("x_amd64_test.go", "windows", "amd64", true),
+            ("x_amd64_test.go", "windows", "386", false),
+            ("x_windows.go", "windows", "arm64", true),
+            // Only the last one or two elements count.
+            ("x_linux_helper_test.go", "windows", "amd64", true),
+            ("linux_amd64_test.go", "windows", "arm64", false),
+            // _GOOS suffixes honour the same aliases as build tags.
+            ("x_linux_test.go", "android", "arm64", true),
+            ("x_darwin_test.go", "ios", "arm64", true),
+            ("x_android_test.go", "linux", "arm64", false),
+        ];
+
+        for (name, goos, goarch, want) in cases {
+            assert_eq!(
+                context(goos, goarch, None).matches_file_name(Path::new(name)),
+                want,
+                "{} on {}/{}",
+                name,
+                goos,
+                goarch
+            );
+        }
+    }
+}
@@ -0,0 +1,123 @@
+use anyhow::{Result, bail};
+use skim::prelude::*;
+
+/// Splits a command line the way a POSIX shell would for plain words: on
+/// whitespace, keeping quoted parts together. Single quotes are literal,
+/// backslashes escape the next character outside them.
+pub fn split(line: &str) -> Result<Vec<String>> {
+    let mut words = Vec::new();
+    let mut word = String::new();
+    let mut in_word = false;
+    let mut quote = None;
+    let mut chars = line.chars();
+
+    while let Some(c) = chars.next() {
+        match (quote, c) {
+            (Some('\''), '\'') | (Some('"'), '"') => quote = None,
+            (Some('"'), '\\') | (None, '\\') => match chars.next() {
+                Some(escaped) => word.push(escaped),
+                None => bail!("trailing backslash in {:?}", line),
+            },
+            (Some(_), c) => word.push(c),
+            (None, '\'' | '"') => {
+                quote = Some(c);
+                in_word = true;
+            }
+            (None, c) if c.is_whitespace() => {
+                if in_word {
+                    words.push(std::mem::take(&mut word));
+                    in_word = false;
+                }
+            }
+            (None, c) => {
+                word.push(c);
+                in_word = true;
+            }
+        }
+    }
+
+    if quote.is_some() {
+        bail!("unterminated quote in {:?}", line);
+    }
+    if in_word {
+        words.push(word);
+    }
+
+    Ok(words)
+}
+
+/// Applies fzf-style options to the skim options, overriding the defaults.
+/// Options take their value as `--opt=value` or `--opt value`.
+pub fn apply(builder: &mut SkimOptionsBuilder, args: &[String]) -> Result<()> {
+    let mut args = args.iter();
+    let mut binds = Vec::new();
+
+    while let Some(arg) = args.next() {
+        let (name, inline) = match arg.split_once('=') {
+            Some((name, value)) => (name, Some(value.to_string())),
+            None => (arg.as_str(), None),
+        };
+
+        let mut value = || -> Result<String> {
+            match inline.clone().or_else(|| args.next().cloned()) {
+                Some(value) => Ok(value),
+                None => bail!("--fzf-args: {} needs a value", name),
+            }
+        };
+
+        match name {
+            "--height" => {
+                builder.height(value()?);
+            }
+            "--prompt" => {
+                builder.prompt(value()?);
+            }
+            "--header" => {
+                builder.header(Some(value()?));
+            }
+            "--query" | "-q" => {
+                builder.query(Some(value()?));
+            }
+            "--color" => {
+                builder.color(Some(value()?));
+            }
+            "--preview" => {
+                builder.preview(Some(value()?));
+            }
+            "--preview-window" => {
+                builder.preview_window(value()?);
+            }
+            "--layout" => {
+                builder.layout(value()?);
+            }
+            "--bind" => binds.push(value()?),
+            "--no-preview" => {
+                builder.preview(None);
+            }
+            "--reverse" => {
+                builder.reverse(true);
+            }
+            "--exact" | "-e" => {
+                builder.exact(true);
+            }
+            "--no-sort" => {
+                builder.no_sort(true);
+            }
+            "--ansi" => {
+                builder.ansi(true);
+            }
+            _ => bail!(
+                "--fzf-args: unsupported option {:?}; supported are --height, --prompt, \
+                 --header, --query, --color, --preview, --preview-window, --no-preview, \
+                 --layout, --bind, --reverse, --exact, --no-sort and --ansi",
+                arg
+            ),
+        }
+    }
+
+    if !binds.is_empty() {
+        builder.bind(binds);
+    }
+
+    Ok(())
+}
@@ -0,0 +1,13 @@
+use std::path::PathBuf;
+
+/// Returns the directory gotestfinder keeps its state in, such as test
+/// history, or `None` when no suitable location is known.
+pub fn state_dir() -> Option<PathBuf> {
+    let base = std::env::var_os("XDG_CACHE_HOME")
+        .filter(|dir| !dir.is_empty())
+        .map(PathBuf::from)
+        .or_else(|| std::env::var_os("LOCALAPPDATA").map(PathBuf::from))
+        .or_else(|| std::env::var_os("HOME").map(|home| PathBuf::from(home).join(".cache")))?;
+
+    Some(base.join("gotestfinder"))
+}
@@ -0,0 +1,70 @@
+use serde_json::Value;
+
+/// Formats a JSON value as a YAML block document. Strings are written as
+/// JSON strings, which YAML reads as double-quoted scalars, so no value is
+/// ever mistaken for a number, boolean or null.
+pub fn to_string(value: &Value) -> String {
+    let mut out = String::new();
+
+    if is_block(value) {
+        write_block(&mut out, value, 0);
+    } else {
+        out.push_str(&scalar(value));
+        out.push('\n');
+    }
+
+    out
+}
+
+/// Writes the entries of a non-empty array or object on lines of their own,
+/// indented by `indent`.
+fn write_block(out: &mut String, value: &Value, indent: usize) {
+    let pad = " ".repeat(indent);
+
+    match value {
+        Value::Array(items) => {
+            for item in items {
+                // Write the item as if nested, then put the dash in front of
+                // its first line.
+                let mut entry = String::new();
+                if is_block(item) {
+                    write_block(&mut entry, item, indent + 2);
+                } else {
+                    entry = format!("{}  {}\n", pad, scalar(item));
+                }
+                out.push_str(&pad);
+                out.push_str("- ");
+                out.push_str(&entry[indent + 2..]);
+            }
+        }
+        Value::Object(fields) => {
+            for (key, field) in fields {
+                out.push_str(&format!("{}{}:", pad, key));
+                if is_block(field) {
+                    out.push('\n');
+                    write_block(out, field, indent + 2);
+                } else {
+                    out.push_str(&format!(" {}\n", scalar(field)));
+                }
+            }
+        }
+        _ => unreachable!("only collections are written as blocks"),
+    }
+}
+
+fn is_block(value: &Value) -> bool {
+    match value {
+        Value::Array(items) => !items.is_empty(),
+        Value::Object(fields) => !fields.is_empty(),
+        _ => false,
+    }
+}
+
+/// Formats a scalar or an empty collection in flow style.
+fn scalar(value: &Value) -> String {
+    match value {
+        Value::Array(_) => "[]".to_string(),
+        Value::Object(_) => "{}".to_string(),
+        _ => value.to_string(),
+    }
+}
@@ -0,0 +1,13 @@
+package alpha
+
+import "testing"
+
+func TestSecond(t *testing.T) {}
+
+func TestFirst(t *testing.T) {
+	for name := range map[string]int{"z": 1, "y": 2} {
+		t.Run(name, func(t *testing.T) {})
+	}
+}
+
+func ExampleFirst() {}
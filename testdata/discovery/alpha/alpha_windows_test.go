@@ -0,0 +1,5 @@
+package alpha
+
+import "testing"
+
+func TestWindowsOnly(t *testing.T) {}
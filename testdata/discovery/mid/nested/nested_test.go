@@ -0,0 +1,9 @@
+//go:build !nested_off
+
+package nested
+
+import "testing"
+
+func FuzzNested(f *testing.F) {}
+
+func TestNested(t *testing.T) {}
@@ -0,0 +1,5 @@
+package zeta_test
+
+import "testing"
+
+func BenchmarkZeta(b *testing.B) {}
@@ -0,0 +1,10 @@
+package zeta
+
+import "testing"
+
+func TestZulu(t *testing.T) {
+	t.Run("b", func(t *testing.T) {})
+	t.Run("a", func(t *testing.T) {})
+}
+
+func TestAlpha(t *testing.T) {}
@@ -0,0 +1,50 @@
+package subtests
+
+import "testing"
+
+// check runs one case as a subtest named after its name parameter.
+func check(t *testing.T, name string, in int) {
+	t.Helper()
+	t.Run(name, func(t *testing.T) {
+		_ = in
+	})
+}
+
+// checkAll passes its name on to check, one helper deeper.
+func checkAll(t *testing.T, name string) {
+	check(t, name, 0)
+}
+
+// group adds a fixed subtest with nested ones from its callers' literals.
+func group(t *testing.T, label string) {
+	t.Run("group", func(t *testing.T) {
+		check(t, label, 1)
+	})
+}
+
+// never is not called from any test, so its subtests belong to none.
+func never(t *testing.T, name string) {
+	t.Run(name, func(t *testing.T) {})
+	t.Run("never fixed", func(t *testing.T) {})
+}
+
+func TestLiterals(t *testing.T) {
+	check(t, "empty", 0)
+	check(t, "one", 1)
+}
+
+func TestNestedHelper(t *testing.T) {
+	checkAll(t, "through two helpers")
+	t.Run("parent", func(t *testing.T) {
+		checkAll(t, "below parent")
+	})
+}
+
+func TestFixedInHelper(t *testing.T) {
+	group(t, "labelled")
+}
+
+func TestComputedName(t *testing.T) {
+	name := "computed"
+	check(t, name+"!", 2)
+}
@@ -0,0 +1,70 @@
+package subtests
+
+import (
+	"strings"
+	"testing"
+)
+
+type splitCase struct {
+	name, in string
+	want []string // nil for no parts
+	opts struct {
+		sep string
+	}
+}
+
+func TestInlineKeyed(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want int
+	}{
+		{name: "empty", in: "", want: 0},
+		{
+			name: "with, comma",
+			in:   "a,b", // two
+			want: 2,
+		},
+		{in: "no name", want: 1},
+		{name: strings.ToUpper("computed"), in: "x"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_ = tc
+		})
+	}
+}
+
+func TestInlinePositional(t *testing.T) {
+	for _, tt := range []struct {
+		desc     string
+		in, want int
+	}{
+		{"zero", 0, 0},
+		{"double {braces}", f(1, 2), 2},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {})
+	}
+}
+
+func TestNamedType(t *testing.T) {
+	cases := []*splitCase{
+		{name: "keyed", in: "a b", want: []string{"a", "b"}},
+		{"positional", "a", nil, struct{ sep string }{" "}},
+	}
+	for i, c := range cases {
+		_ = i
+		t.Run(c.name, func(t *testing.T) {})
+	}
+}
+
+func TestMapCases(t *testing.T) {
+	cases := map[string]struct{ in, want int }{
+		"first": {in: 1, want: 1},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) { _ = tc })
+	}
+}
+
+func f(a, b int) int { return a + b }